@@ -83,10 +83,11 @@ func NewControllerPeerChans() *ControllerPeerChans {
 
 type ControllerDiskIOChans struct {
 	receivedPiece chan ReceivedPiece // Other end is IO 
+	failedPiece   chan ReceivedPiece // Other end is IO. Used when a piece fails hash verification.
 }
 
 func NewControllerDiskIOChans() *ControllerDiskIOChans {
-	return &ControllerDiskIOChans{ receivedPiece: make(chan ReceivedPiece) }
+	return &ControllerDiskIOChans{ receivedPiece: make(chan ReceivedPiece), failedPiece: make(chan ReceivedPiece) }
 }
 
 type ControllerPeerManagerChans struct {
@@ -440,6 +441,26 @@ func (cont *Controller) Run() {
 					cont.sendRequestsToPeer(peerInfo, raritySlice)
 				}
 			}
+
+		case piece := <- cont.rxChans.diskIO.failedPiece:
+
+			peerInfo, exists := cont.peers[piece.peerName]
+
+			if !exists {
+				log.Printf("Controller : Run (Failed Piece) : WARNING. Was notified that piece %d from %s failed, but it doesn't currently exist in the peers mapping.", piece.pieceNum, piece.peerName)
+				break
+			}
+			log.Printf("Controller : Run (Failed Piece) : Piece %d from %s failed verification", piece.pieceNum, piece.peerName)
+
+			// Forget about the request so the piece can be requested again
+			if _, exists := peerInfo.activeRequests[piece.pieceNum]; exists {
+				delete(peerInfo.activeRequests, piece.pieceNum)
+				cont.activeRequestsTotals[piece.pieceNum]--
+			}
+
+			if !peerInfo.isChoked && len(peerInfo.activeRequests) < cont.maxSimultaneousDownloadsPerPeer {
+				cont.sendRequestsToPeer(peerInfo, cont.createRaritySlice())
+			}
 		// === END OF MESSAGES FROM DISK_IO === 
 
 
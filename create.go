@@ -0,0 +1,248 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"code.google.com/p/bencode-go"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// Automatically chosen piece lengths aim for roughly this many pieces
+	targetPieceCount = 1500
+)
+
+// CreateOptions describes a torrent to be created from a file or directory
+type CreateOptions struct {
+	Path         string
+	PieceLength  int // 0 selects a piece length based on the total size
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	Private      bool
+}
+
+type createFile struct {
+	name   string // path on disk
+	length int64
+	path   []string // path components relative to the torrent root
+}
+
+// choosePieceLength returns the smallest power of two piece length that
+// splits totalLength into no more than targetPieceCount pieces
+func choosePieceLength(totalLength int64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/int64(pieceLength) > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// collectFiles returns the regular files under root in lexical order
+func collectFiles(root string) (files []createFile, err error) {
+	err = filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{name, fi.Size(), strings.Split(filepath.ToSlash(rel), "/")})
+		return nil
+	})
+	return
+}
+
+// hashPieces reads the files in order as one continuous stream and returns
+// the concatenated SHA-1 hashes of each piece
+func hashPieces(files []createFile, pieceLength int) (string, error) {
+	var pieces []byte
+	buf := make([]byte, pieceLength)
+	m := 0
+	for _, f := range files {
+		file, err := os.Open(f.name)
+		if err != nil {
+			return "", err
+		}
+		for {
+			n, err := io.ReadFull(file, buf[m:])
+			m += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				file.Close()
+				return "", err
+			}
+			h := sha1.Sum(buf)
+			pieces = append(pieces, h[:]...)
+			m = 0
+		}
+		file.Close()
+	}
+	// Hash the final partial piece
+	if m > 0 {
+		h := sha1.Sum(buf[:m])
+		pieces = append(pieces, h[:]...)
+	}
+	return string(pieces), nil
+}
+
+// CreateTorrent builds the metainfo dictionary for the file or directory
+// described by opts, ready to be bencoded into a .torrent file
+func CreateTorrent(opts CreateOptions) (map[string]interface{}, error) {
+	fi, err := os.Stat(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := collectFiles(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No files found in %s", opts.Path)
+	}
+
+	var totalLength int64
+	for _, f := range files {
+		totalLength += f.length
+	}
+	if totalLength == 0 {
+		return nil, errors.New("Cannot create a torrent of zero length")
+	}
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(totalLength)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("Piece length %d must be a power of two of at least %d", pieceLength, minPieceLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         filepath.Base(filepath.Clean(opts.Path)),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if fi.IsDir() {
+		var fileList []interface{}
+		for _, f := range files {
+			fileList = append(fileList, map[string]interface{}{"length": f.length, "path": f.path})
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = totalLength
+	}
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	metaInfo := map[string]interface{}{
+		"info":          info,
+		"creation date": time.Now().Unix(),
+	}
+	if len(opts.AnnounceList) > 0 {
+		metaInfo["announce"] = opts.AnnounceList[0][0]
+		metaInfo["announce-list"] = opts.AnnounceList
+	}
+	if opts.Comment != "" {
+		metaInfo["comment"] = opts.Comment
+	}
+	if opts.CreatedBy != "" {
+		metaInfo["created by"] = opts.CreatedBy
+	}
+
+	log.Printf("Create : CreateTorrent : %d files, %d bytes, %d pieces of %d bytes\n", len(files), totalLength, len(pieces)/20, pieceLength)
+	return metaInfo, nil
+}
+
+// WriteTorrentFile bencodes the metainfo dictionary into the named file
+func WriteTorrentFile(filename string, metaInfo map[string]interface{}) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err = bencode.Marshal(file, metaInfo); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// trackerTiers implements flag.Value. Each occurrence of the flag adds a
+// tier of comma separated tracker URLs.
+type trackerTiers [][]string
+
+func (tt *trackerTiers) String() string {
+	return fmt.Sprint(*tt)
+}
+
+func (tt *trackerTiers) Set(value string) error {
+	var tier []string
+	for _, tr := range strings.Split(value, ",") {
+		if tr = strings.TrimSpace(tr); tr != "" {
+			tier = append(tier, tr)
+		}
+	}
+	if len(tier) == 0 {
+		return errors.New("empty tracker tier")
+	}
+	*tt = append(*tt, tier)
+	return nil
+}
+
+// createMain implements the create subcommand
+func createMain(args []string) {
+	var opts CreateOptions
+	var announce trackerTiers
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	output := fs.String("o", "", "output `file` (default <name>.torrent)")
+	fs.Var(&announce, "a", "comma separated tracker `URLs` forming one tier (repeatable)")
+	fs.IntVar(&opts.PieceLength, "piece-length", 0, "piece length in `bytes` (default chosen from the total size)")
+	fs.StringVar(&opts.Comment, "comment", "", "free form comment")
+	fs.StringVar(&opts.CreatedBy, "created-by", "Tulva", "creator of the torrent")
+	fs.BoolVar(&opts.Private, "private", false, "set the private flag")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s create [options] <file | directory>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.Path = fs.Arg(0)
+	opts.AnnounceList = announce
+
+	metaInfo, err := CreateTorrent(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	if err = WriteTorrentFile(*output, metaInfo); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Create : Wrote %s\n", *output)
+}
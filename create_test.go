@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChoosePieceLength(t *testing.T) {
+	if l := choosePieceLength(1000); l != minPieceLength {
+		t.Errorf("Expected piece length %d for a small file but it was %d", minPieceLength, l)
+	}
+	if l := choosePieceLength(1 << 30); l != 1<<20 {
+		t.Errorf("Expected piece length %d for 1 GiB but it was %d", 1<<20, l)
+	}
+	if l := choosePieceLength(1 << 50); l != maxPieceLength {
+		t.Errorf("Expected piece length to be capped at %d but it was %d", maxPieceLength, l)
+	}
+}
+
+func TestCreateTorrentMultiFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "content")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	a := bytes.Repeat([]byte{'a'}, 20000)
+	b := bytes.Repeat([]byte{'b'}, 30000)
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), a, 0644)
+	ioutil.WriteFile(filepath.Join(root, "sub", "b.txt"), b, 0644)
+
+	opts := CreateOptions{
+		Path:         root,
+		AnnounceList: [][]string{{"http://tracker.example.com/announce"}, {"http://backup.example.com/announce"}},
+		Comment:      "test",
+		Private:      true,
+	}
+	metaInfo, err := CreateTorrent(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "content.torrent")
+	if err = WriteTorrentFile(filename, metaInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := ParseTorrentFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := torrent.metaInfo.Info
+	if info.Name != "content" || info.PieceLength != minPieceLength || info.Private != 1 {
+		t.Errorf("Unexpected info dictionary %+v", info)
+	}
+	if len(info.Files) != 2 || info.Files[1].Length != 30000 || filepath.Join(info.Files[1].Path...) != filepath.Join("sub", "b.txt") {
+		t.Errorf("Unexpected files %+v", info.Files)
+	}
+	if torrent.metaInfo.Announce != opts.AnnounceList[0][0] || len(torrent.metaInfo.AnnounceList) != 2 {
+		t.Errorf("Unexpected trackers %s %v", torrent.metaInfo.Announce, torrent.metaInfo.AnnounceList)
+	}
+
+	// The second piece spans the boundary between both files
+	content := append(a, b...)
+	if len(info.Pieces) != 20*4 {
+		t.Fatalf("Expected 4 pieces but there were %d", len(info.Pieces)/20)
+	}
+	h := sha1.Sum(content[minPieceLength : 2*minPieceLength])
+	if info.Pieces[20:40] != string(h[:]) {
+		t.Errorf("Hash of piece 1 is incorrect")
+	}
+	h = sha1.Sum(content[3*minPieceLength:])
+	if info.Pieces[60:80] != string(h[:]) {
+		t.Errorf("Hash of the final partial piece is incorrect")
+	}
+}
+
+func TestCreateTorrentSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "single.bin")
+	ioutil.WriteFile(name, []byte("hello"), 0644)
+	metaInfo, err := CreateTorrent(CreateOptions{Path: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := metaInfo["info"].(map[string]interface{})
+	if info["length"] != int64(5) || info["name"] != "single.bin" {
+		t.Errorf("Unexpected info dictionary %v", info)
+	}
+	if _, ok := info["files"]; ok {
+		t.Errorf("Single file torrent shouldn't have a files list")
+	}
+	if _, err = CreateTorrent(CreateOptions{Path: name, PieceLength: 1000}); err == nil {
+		t.Errorf("Expected an error for a piece length that isn't a power of two")
+	}
+}
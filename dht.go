@@ -0,0 +1,853 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/tomb"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Nodes held in each bucket of the routing table, and the number of
+	// closest nodes that a lookup looks for
+	dhtK = 8
+	// Queries sent at once during a lookup
+	dhtAlpha = 3
+	// Nodes are dropped from the routing table after this many queries in a
+	// row go unanswered
+	dhtMaxFailures = 3
+	// A node that hasn't been heard from for this long may be replaced
+	dhtNodeStale = 15 * time.Minute
+	// Tokens are valid for between one and two rotation periods
+	dhtTokenRotation = 5 * time.Minute
+	// Peers announced to us are forgotten after this long
+	dhtPeerExpiry = 30 * time.Minute
+	// How often we look up peers for our torrents and announce to the DHT
+	dhtSearchInterval = 15 * time.Minute
+	// The most peers returned for a get_peers query
+	dhtMaxValues = 50
+)
+
+// KRPC error codes
+const (
+	krpcGenericError  = 201
+	krpcServerError   = 202
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+// Give up on a query after this long
+var dhtQueryTimeout = 5 * time.Second
+
+// DHT nodes that are always up, used to join the DHT
+var defaultDHTBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	errDHTTimeout = errors.New("DHT query timed out")
+	errDHTStopped = errors.New("DHT stopped")
+)
+
+// krpcError is an error message from another node
+type krpcError struct {
+	code    int
+	message string
+}
+
+func (e krpcError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.code, e.message)
+}
+
+// dhtNode is a node in the routing table
+type dhtNode struct {
+	id       string
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int // queries in a row that went unanswered
+}
+
+// commonPrefixLen returns the number of leading bits that two IDs share
+func commonPrefixLen(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
+
+// closerTo returns true if a is closer to target than b by the XOR metric
+func closerTo(target, a, b string) bool {
+	for i := 0; i < len(target); i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// sortByDistance sorts nodes from closest to furthest from target
+func sortByDistance(target string, nodes []*dhtNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return closerTo(target, nodes[i].id, nodes[j].id)
+	})
+}
+
+// routingTable holds the nodes we know of in k-buckets. Bucket i holds the
+// nodes whose IDs share exactly i leading bits with ours, so the buckets
+// covering the space near us are the most detailed.
+type routingTable struct {
+	self    string
+	buckets [160][]*dhtNode
+	mutex   sync.Mutex
+}
+
+func newRoutingTable(self string) *routingTable {
+	return &routingTable{self: self}
+}
+
+// insert adds a node that we've heard from, or marks it as seen. A full
+// bucket only takes the node if one of its nodes has gone bad or stale.
+func (rt *routingTable) insert(id string, addr *net.UDPAddr) {
+	if len(id) != 20 || id == rt.self {
+		return
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	i := commonPrefixLen(rt.self, id)
+	bucket := rt.buckets[i]
+	for j, node := range bucket {
+		if node.id == id {
+			// Keep the bucket ordered from least to most recently seen
+			copy(bucket[j:], bucket[j+1:])
+			bucket[len(bucket)-1] = node
+			node.addr = addr
+			node.lastSeen = time.Now()
+			node.failures = 0
+			return
+		}
+	}
+	node := &dhtNode{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < dhtK {
+		rt.buckets[i] = append(bucket, node)
+		return
+	}
+	for j, old := range bucket {
+		if old.failures > 0 || time.Since(old.lastSeen) > dhtNodeStale {
+			copy(bucket[j:], bucket[j+1:])
+			bucket[len(bucket)-1] = node
+			return
+		}
+	}
+}
+
+// failed records an unanswered query, and drops the node once it has
+// failed too often
+func (rt *routingTable) failed(id string) {
+	if len(id) != 20 || id == rt.self {
+		return
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	i := commonPrefixLen(rt.self, id)
+	for j, node := range rt.buckets[i] {
+		if node.id == id {
+			if node.failures++; node.failures >= dhtMaxFailures {
+				rt.buckets[i] = append(rt.buckets[i][:j], rt.buckets[i][j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns copies of up to n nodes closest to target
+func (rt *routingTable) closest(target string, n int) []*dhtNode {
+	rt.mutex.Lock()
+	var nodes []*dhtNode
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			copied := *node
+			nodes = append(nodes, &copied)
+		}
+	}
+	rt.mutex.Unlock()
+
+	sortByDistance(target, nodes)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// size returns the number of nodes in the routing table
+func (rt *routingTable) size() (n int) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return
+}
+
+// encodeNodes returns the compact node info of IPv4 nodes: each node's ID
+// followed by its address and port
+func encodeNodes(nodes []*dhtNode) string {
+	var b []byte
+	for _, node := range nodes {
+		if ip4 := node.addr.IP.To4(); ip4 != nil {
+			b = append(b, node.id...)
+			b = append(b, ip4...)
+			b = append(b, byte(node.addr.Port>>8), byte(node.addr.Port))
+		}
+	}
+	return string(b)
+}
+
+// decodeNodes parses compact node info
+func decodeNodes(s string) ([]*dhtNode, error) {
+	if len(s)%26 != 0 {
+		return nil, fmt.Errorf("compact node info length %d is not a multiple of 26", len(s))
+	}
+	var nodes []*dhtNode
+	for i := 0; i < len(s); i += 26 {
+		ip := net.IPv4(s[i+20], s[i+21], s[i+22], s[i+23])
+		port := int(s[i+24])<<8 | int(s[i+25])
+		nodes = append(nodes, &dhtNode{id: s[i : i+20], addr: &net.UDPAddr{IP: ip, Port: port}})
+	}
+	return nodes, nil
+}
+
+// krpcMessage is a decoded KRPC message
+type krpcMessage struct {
+	transaction string
+	kind        string // q, r or e
+	method      string
+	args        map[string]interface{} // the arguments of a query or the values of a response
+	err         krpcError
+	addr        *net.UDPAddr
+}
+
+// parseKRPC decodes a KRPC message
+func parseKRPC(buf []byte, addr *net.UDPAddr) (*krpcMessage, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("KRPC message is not a dictionary")
+	}
+	msg := &krpcMessage{addr: addr}
+	msg.transaction, _ = dict["t"].(string)
+	msg.kind, _ = dict["y"].(string)
+	switch msg.kind {
+	case "q":
+		msg.method, _ = dict["q"].(string)
+		msg.args, _ = dict["a"].(map[string]interface{})
+	case "r":
+		msg.args, _ = dict["r"].(map[string]interface{})
+	case "e":
+		list, _ := dict["e"].([]interface{})
+		if len(list) == 2 {
+			code, _ := list[0].(int64)
+			message, _ := list[1].(string)
+			msg.err = krpcError{int(code), message}
+		}
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type %q", msg.kind)
+	}
+	if msg.kind != "e" && msg.args == nil {
+		return nil, errors.New("KRPC message has no arguments")
+	}
+	return msg, nil
+}
+
+// dhtTransaction is a query waiting for its response
+type dhtTransaction struct {
+	addr     *net.UDPAddr
+	response chan *krpcMessage
+}
+
+type dhtPeerChans struct {
+	peers chan PeerTuple // Other end is the PeerManager
+}
+
+// DHT is a node in the mainline DHT (BEP 5). It finds peers for our
+// torrents, announces that we have them, and answers other nodes' queries.
+type DHT struct {
+	id           string
+	conn         *net.UDPConn
+	table        *routingTable
+	bootstrap    []string   // addresses of nodes used to join the DHT
+	stateFile    string     // where the node ID and routing table are kept between runs
+	cached       []*dhtNode // nodes loaded from the state file
+	infoHashes   [][]byte   // torrents to find peers for
+	port         uint16     // port that our peers listen on
+	peerChans    dhtPeerChans
+	mutex        sync.Mutex // guards the fields below
+	transactions map[string]dhtTransaction
+	transaction  uint16
+	secrets      [2][]byte                       // current and previous token secrets
+	storage      map[string]map[string]time.Time // compact peers announced for each info hash, with their expiry
+	t            tomb.Tomb
+}
+
+// randomSecret returns a new random token secret or node ID
+func randomSecret() []byte {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+// NewDHT returns a DHT node listening on addr. If stateFile isn't empty,
+// the node ID and routing table are loaded from it and saved to it when
+// the DHT is stopped.
+func NewDHT(addr string, bootstrap []string, stateFile string) (*DHT, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	d := new(DHT)
+	d.id = string(randomSecret())
+	d.conn = conn
+	d.table = newRoutingTable(d.id)
+	d.bootstrap = bootstrap
+	d.transactions = make(map[string]dhtTransaction)
+	d.secrets = [2][]byte{randomSecret(), randomSecret()}
+	d.storage = make(map[string]map[string]time.Time)
+	d.stateFile = stateFile
+	if stateFile != "" {
+		if err = d.loadState(); err != nil && !os.IsNotExist(err) {
+			log.Println("DHT : NewDHT : Unable to load state:", err)
+		}
+	}
+	log.Println("DHT : Listening on", conn.LocalAddr())
+	return d, nil
+}
+
+// Addr returns the address that the DHT is listening on
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// send writes a bencoded message to addr
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, msg); err != nil {
+		return err
+	}
+	_, err := d.conn.WriteToUDP(b.Bytes(), addr)
+	return err
+}
+
+// query sends a query to addr and waits for the response. The node that
+// answers is added to the routing table.
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = d.id
+	response := make(chan *krpcMessage, 1)
+	d.mutex.Lock()
+	d.transaction++
+	transaction := string([]byte{byte(d.transaction >> 8), byte(d.transaction)})
+	d.transactions[transaction] = dhtTransaction{addr, response}
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.transactions, transaction)
+		d.mutex.Unlock()
+	}()
+
+	if err := d.send(addr, map[string]interface{}{"t": transaction, "y": "q", "q": method, "a": args}); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-response:
+		if msg.kind == "e" {
+			return nil, msg.err
+		}
+		id, _ := msg.args["id"].(string)
+		if len(id) != 20 {
+			return nil, errors.New("response has no node ID")
+		}
+		d.table.insert(id, addr)
+		return msg.args, nil
+	case <-time.After(dhtQueryTimeout):
+		return nil, errDHTTimeout
+	case <-d.t.Dying():
+		return nil, errDHTStopped
+	}
+}
+
+// token returns the token that a node at addr must present to announce
+// itself, made with the given secret
+func token(secret []byte, addr *net.UDPAddr) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(addr.IP.To16())
+	return string(h.Sum(nil)[:8])
+}
+
+// validToken returns true if the token was given to addr during this or
+// the previous rotation period
+func (d *DHT) validToken(t string, addr *net.UDPAddr) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return t == token(d.secrets[0], addr) || t == token(d.secrets[1], addr)
+}
+
+// rotateSecrets replaces the token secrets and forgets expired peers
+func (d *DHT) rotateSecrets() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.secrets[1] = d.secrets[0]
+	d.secrets[0] = randomSecret()
+	now := time.Now()
+	for infoHash, peers := range d.storage {
+		for peer, expiry := range peers {
+			if now.After(expiry) {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.storage, infoHash)
+		}
+	}
+}
+
+// storedPeers returns up to dhtMaxValues peers announced for an info hash
+func (d *DHT) storedPeers(infoHash string) (values []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for peer := range d.storage[infoHash] {
+		if len(values) == dhtMaxValues {
+			break
+		}
+		values = append(values, peer)
+	}
+	return
+}
+
+// handleQuery answers a query from another node
+func (d *DHT) handleQuery(msg *krpcMessage) {
+	reply := func(values map[string]interface{}) {
+		values["id"] = d.id
+		d.send(msg.addr, map[string]interface{}{"t": msg.transaction, "y": "r", "r": values})
+	}
+	fail := func(code int, message string) {
+		d.send(msg.addr, map[string]interface{}{"t": msg.transaction, "y": "e", "e": []interface{}{code, message}})
+	}
+
+	id, _ := msg.args["id"].(string)
+	if len(id) != 20 {
+		fail(krpcProtocolError, "invalid id")
+		return
+	}
+	d.table.insert(id, msg.addr)
+
+	switch msg.method {
+	case "ping":
+		reply(map[string]interface{}{})
+	case "find_node":
+		target, _ := msg.args["target"].(string)
+		if len(target) != 20 {
+			fail(krpcProtocolError, "invalid target")
+			return
+		}
+		reply(map[string]interface{}{"nodes": encodeNodes(d.table.closest(target, dhtK))})
+	case "get_peers":
+		infoHash, _ := msg.args["info_hash"].(string)
+		if len(infoHash) != 20 {
+			fail(krpcProtocolError, "invalid info_hash")
+			return
+		}
+		d.mutex.Lock()
+		values := map[string]interface{}{"token": token(d.secrets[0], msg.addr)}
+		d.mutex.Unlock()
+		if peers := d.storedPeers(infoHash); len(peers) > 0 {
+			values["values"] = peers
+		} else {
+			values["nodes"] = encodeNodes(d.table.closest(infoHash, dhtK))
+		}
+		reply(values)
+	case "announce_peer":
+		infoHash, _ := msg.args["info_hash"].(string)
+		t, _ := msg.args["token"].(string)
+		port, _ := msg.args["port"].(int64)
+		if implied, _ := msg.args["implied_port"].(int64); implied != 0 {
+			port = int64(msg.addr.Port)
+		}
+		if len(infoHash) != 20 || port <= 0 || port > 65535 {
+			fail(krpcProtocolError, "invalid announce")
+			return
+		}
+		if !d.validToken(t, msg.addr) {
+			fail(krpcProtocolError, "bad token")
+			return
+		}
+		ip4 := msg.addr.IP.To4()
+		if ip4 == nil {
+			fail(krpcGenericError, "only IPv4 peers are stored")
+			return
+		}
+		peer := string(append(append([]byte(nil), ip4...), byte(port>>8), byte(port)))
+		d.mutex.Lock()
+		if d.storage[infoHash] == nil {
+			d.storage[infoHash] = make(map[string]time.Time)
+		}
+		d.storage[infoHash][peer] = time.Now().Add(dhtPeerExpiry)
+		d.mutex.Unlock()
+		reply(map[string]interface{}{})
+	default:
+		fail(krpcMethodUnknown, "method unknown")
+	}
+}
+
+// serve reads messages until the connection is closed. Responses are
+// passed to the query waiting for them.
+func (d *DHT) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.t.Dying():
+			default:
+				log.Println("DHT : serve :", err)
+				d.t.Kill(err)
+			}
+			return
+		}
+		msg, err := parseKRPC(buf[:n], addr)
+		if err != nil {
+			continue
+		}
+		if msg.kind == "q" {
+			d.handleQuery(msg)
+			continue
+		}
+		d.mutex.Lock()
+		transaction, ok := d.transactions[msg.transaction]
+		d.mutex.Unlock()
+		// Only accept the response from the node that was asked
+		if ok && transaction.addr.IP.Equal(addr.IP) && transaction.addr.Port == addr.Port {
+			select {
+			case transaction.response <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// lookupResult is a response received during a lookup
+type lookupResult struct {
+	node *dhtNode
+	args map[string]interface{}
+	err  error
+}
+
+// lookup iteratively queries the nodes closest to target until the
+// closest ones have all been asked. With getPeers it asks for the peers of
+// the info hash target, and returns the peers along with the closest nodes
+// that answered and the token each of them gave us.
+func (d *DHT) lookup(target string, getPeers bool) (peers []PeerTuple, closest []*dhtNode, tokens map[string]string) {
+	tokens = make(map[string]string)
+	candidates := d.table.closest(target, dhtK)
+	seen := make(map[string]bool) // by address, since IDs aren't trusted
+	for _, node := range candidates {
+		seen[node.addr.String()] = true
+	}
+	queried := make(map[string]bool)
+	peerSeen := make(map[string]bool)
+
+	for {
+		// Ask up to dhtAlpha of the closest nodes that haven't been asked
+		var batch []*dhtNode
+		for i := 0; i < len(candidates) && i < dhtK && len(batch) < dhtAlpha; i++ {
+			if !queried[candidates[i].addr.String()] {
+				batch = append(batch, candidates[i])
+				queried[candidates[i].addr.String()] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, node := range batch {
+			go func(node *dhtNode) {
+				var args map[string]interface{}
+				var err error
+				if getPeers {
+					args, err = d.query(node.addr, "get_peers", map[string]interface{}{"info_hash": target})
+				} else {
+					args, err = d.query(node.addr, "find_node", map[string]interface{}{"target": target})
+				}
+				results <- lookupResult{node, args, err}
+			}(node)
+		}
+
+		var answered []*dhtNode
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				d.table.failed(result.node.id)
+				continue
+			}
+			// The node may have told us its real ID
+			result.node.id, _ = result.args["id"].(string)
+			answered = append(answered, result.node)
+			if t, ok := result.args["token"].(string); ok {
+				tokens[result.node.id] = t
+			}
+			if nodes, ok := result.args["nodes"].(string); ok {
+				found, _ := decodeNodes(nodes)
+				for _, node := range found {
+					if !seen[node.addr.String()] && node.id != d.id {
+						seen[node.addr.String()] = true
+						candidates = append(candidates, node)
+					}
+				}
+			}
+			values, _ := result.args["values"].([]interface{})
+			for _, value := range values {
+				s, _ := value.(string)
+				found, err := parseCompactPeers(s, net.IPv4len)
+				if err != nil || len(found) != 1 || peerSeen[s] {
+					continue
+				}
+				peerSeen[s] = true
+				peers = append(peers, found[0])
+			}
+		}
+
+		// Nodes that didn't answer are left out of the candidates
+		var remaining []*dhtNode
+		for _, node := range candidates {
+			if !queried[node.addr.String()] {
+				remaining = append(remaining, node)
+			}
+		}
+		closest = append(closest, answered...)
+		sortByDistance(target, closest)
+		if len(closest) > dhtK {
+			closest = closest[:dhtK]
+		}
+		candidates = append(append([]*dhtNode(nil), closest...), remaining...)
+		sortByDistance(target, candidates)
+	}
+	return
+}
+
+// dhtState is the bencoded form of the state file
+type dhtState struct {
+	ID    string "id"
+	Nodes string "nodes" // compact node info
+}
+
+// loadState restores the node ID and the nodes saved by a previous run.
+// The nodes are only added to the routing table once they answer a ping.
+func (d *DHT) loadState() error {
+	f, err := os.Open(d.stateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var state dhtState
+	if err = bencode.Unmarshal(f, &state); err != nil {
+		return err
+	}
+	if len(state.ID) != 20 {
+		return fmt.Errorf("invalid node ID in %s", d.stateFile)
+	}
+	nodes, err := decodeNodes(state.Nodes)
+	if err != nil {
+		return err
+	}
+	d.id = state.ID
+	d.table = newRoutingTable(d.id)
+	d.cached = nodes
+	log.Printf("DHT : loadState : Loaded %d nodes from %s\n", len(d.cached), d.stateFile)
+	return nil
+}
+
+// saveState writes the node ID and the nodes in the routing table that
+// answered their last query. While the table holds fewer than dhtK of
+// them, the nodes loaded at startup are kept too, so that stopping before
+// rejoining the DHT doesn't lose them. The file is replaced in one step so
+// a crash can't leave it half written.
+func (d *DHT) saveState() error {
+	var good []*dhtNode
+	saved := make(map[string]bool)
+	for _, node := range d.table.closest(d.id, len(d.table.buckets)*dhtK) {
+		if node.failures == 0 {
+			good = append(good, node)
+			saved[node.id] = true
+		}
+	}
+	for _, node := range d.cached {
+		if len(good) >= dhtK {
+			break
+		}
+		if !saved[node.id] {
+			good = append(good, node)
+			saved[node.id] = true
+		}
+	}
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, dhtState{d.id, encodeNodes(good)}); err != nil {
+		return err
+	}
+	tmp := d.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.stateFile); err != nil {
+		return err
+	}
+	log.Printf("DHT : saveState : Saved %d nodes to %s\n", len(good), d.stateFile)
+	return nil
+}
+
+// pingAll pings nodes at once and returns when they've all answered or
+// timed out
+func (d *DHT) pingAll(addrs []*net.UDPAddr) {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			if _, err := d.query(addr, "ping", map[string]interface{}{}); err != nil {
+				log.Printf("DHT : pingAll : No answer from %s: %s\n", addr, err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// joinDHT pings the nodes saved by a previous run, falling back to the
+// bootstrap nodes if none of them answer, and then looks up our own ID,
+// which fills the routing table with the nodes near us
+func (d *DHT) joinDHT() {
+	var cached []*net.UDPAddr
+	for _, node := range d.cached {
+		cached = append(cached, node.addr)
+	}
+	d.pingAll(cached)
+	if d.table.size() == 0 {
+		var addrs []*net.UDPAddr
+		for _, addr := range d.bootstrap {
+			udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				log.Printf("DHT : joinDHT : Unable to resolve %s: %s\n", addr, err)
+				continue
+			}
+			addrs = append(addrs, udpAddr)
+		}
+		d.pingAll(addrs)
+	}
+	d.lookup(d.id, false)
+	log.Printf("DHT : joinDHT : %d nodes in the routing table\n", d.table.size())
+}
+
+// search looks up the peers of an info hash, passes them on to the
+// PeerManager, and announces that we're a peer too
+func (d *DHT) search(infoHash []byte) {
+	peers, closest, tokens := d.lookup(string(infoHash), true)
+	log.Printf("DHT : search : Found %d peers for %x\n", len(peers), infoHash)
+	for _, node := range closest {
+		if t, ok := tokens[node.id]; ok {
+			go d.query(node.addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash),
+				"port":      int(d.port),
+				"token":     t,
+			})
+		}
+	}
+	for _, peer := range peers {
+		select {
+		case d.peerChans.peers <- peer:
+		case <-d.t.Dying():
+			return
+		}
+	}
+}
+
+// AddNode pings a node, which adds it to the routing table if it answers.
+// Peers give us their DHT port with the port message.
+func (d *DHT) AddNode(addr *net.UDPAddr) {
+	go d.query(addr, "ping", map[string]interface{}{})
+}
+
+// Stop stops this DHT node
+func (d *DHT) Stop() error {
+	log.Println("DHT : Stop : Stopping")
+	d.t.Kill(nil)
+	return d.t.Wait()
+}
+
+// Run answers queries, and searches for the peers of our torrents every
+// dhtSearchInterval until the DHT is stopped
+func (d *DHT) Run() {
+	log.Println("DHT : Run : Started")
+	defer d.t.Done()
+	defer log.Println("DHT : Run : Completed")
+	go d.serve()
+	search := time.After(0)
+	rotate := time.NewTicker(dhtTokenRotation)
+	defer rotate.Stop()
+
+	for {
+		select {
+		case <-search:
+			go func() {
+				if d.table.size() < dhtK {
+					d.joinDHT()
+				}
+				for _, infoHash := range d.infoHashes {
+					d.search(infoHash)
+				}
+			}()
+			search = time.After(dhtSearchInterval)
+		case <-rotate.C:
+			d.rotateSecrets()
+		case <-d.t.Dying():
+			if d.stateFile != "" {
+				if err := d.saveState(); err != nil {
+					log.Println("DHT : Run : Unable to save state:", err)
+				}
+			}
+			d.conn.Close()
+			return
+		}
+	}
+}
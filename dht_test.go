@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startDHT runs a DHT node on loopback that joins through bootstrap
+func startDHT(t *testing.T, bootstrap []string) *DHT {
+	d, err := NewDHT("127.0.0.1:0", bootstrap, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.peerChans.peers = make(chan PeerTuple, 16)
+	return d
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := string(make([]byte, 20))
+	rt := newRoutingTable(self)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	// Every ID starting with 0x80 shares no bits with ours, so they all
+	// land in the same bucket
+	for i := 0; i < dhtK+2; i++ {
+		id := make([]byte, 20)
+		id[0] = 0x80
+		id[19] = byte(i)
+		rt.insert(string(id), addr)
+	}
+	if rt.size() != dhtK {
+		t.Errorf("Expected a full bucket to hold %d nodes, got %d", dhtK, rt.size())
+	}
+	near := make([]byte, 20)
+	near[19] = 1
+	rt.insert(string(near), addr)
+	rt.insert(self, addr)
+	if rt.size() != dhtK+1 {
+		t.Errorf("Expected %d nodes, got %d", dhtK+1, rt.size())
+	}
+
+	closest := rt.closest(self, 2)
+	if len(closest) != 2 || closest[0].id != string(near) || closest[1].id[0] != 0x80 || closest[1].id[19] != 0 {
+		t.Errorf("Unexpected closest nodes %v", closest)
+	}
+	for i := 0; i < dhtMaxFailures; i++ {
+		rt.failed(string(near))
+	}
+	if rt.size() != dhtK {
+		t.Errorf("Expected a failing node to be dropped")
+	}
+
+	nodes, err := decodeNodes(encodeNodes(closest))
+	if err != nil || len(nodes) != 2 || nodes[0].id != closest[0].id || nodes[0].addr.String() != addr.String() {
+		t.Errorf("Unexpected decoded nodes %v (%v)", nodes, err)
+	}
+}
+
+// A peer announced by one node should be found by another through the
+// rest of the network
+func TestDHTFindsAnnouncedPeer(t *testing.T) {
+	router := startDHT(t, nil)
+	go router.Run()
+	defer router.Stop()
+	bootstrap := []string{router.Addr().String()}
+
+	var nodes []*DHT
+	for i := 0; i < 6; i++ {
+		d := startDHT(t, bootstrap)
+		go d.Run()
+		defer d.Stop()
+		nodes = append(nodes, d)
+	}
+	for _, d := range nodes {
+		d.joinDHT()
+	}
+
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	seeder := nodes[0]
+	seeder.port = 6881
+	seeder.search(infoHash)
+
+	// Announces are sent in the background
+	deadline := time.Now().Add(5 * time.Second)
+	var peers []PeerTuple
+	for len(peers) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		peers, _, _ = nodes[len(nodes)-1].lookup(string(infoHash), true)
+	}
+	if len(peers) != 1 || !peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || peers[0].Port != 6881 {
+		t.Fatalf("Expected to find the announced peer, got %v", peers)
+	}
+
+	leecher := nodes[len(nodes)-1]
+	leecher.port = 6882
+	leecher.search(infoHash)
+	select {
+	case peer := <-leecher.peerChans.peers:
+		if peer.Port != 6881 {
+			t.Errorf("Unexpected peer %v", peer)
+		}
+	default:
+		t.Errorf("Expected the search to pass the peer on")
+	}
+}
+
+func TestDHTRejectsBadToken(t *testing.T) {
+	server := startDHT(t, nil)
+	go server.Run()
+	defer server.Stop()
+	client := startDHT(t, nil)
+	go client.Run()
+	defer client.Stop()
+
+	infoHash := string(bytes.Repeat([]byte{0xcd}, 20))
+	_, err := client.query(server.Addr(), "announce_peer", map[string]interface{}{
+		"info_hash": infoHash,
+		"port":      6881,
+		"token":     "forged",
+	})
+	if e, ok := err.(krpcError); !ok || e.code != krpcProtocolError {
+		t.Errorf("Expected a bad token to be rejected, got %v", err)
+	}
+
+	args, err := client.query(server.Addr(), "get_peers", map[string]interface{}{"info_hash": infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.query(server.Addr(), "announce_peer", map[string]interface{}{
+		"info_hash":    infoHash,
+		"port":         1,
+		"implied_port": 1,
+		"token":        args["token"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := server.storedPeers(infoHash)
+	if len(peers) != 1 || peers[0][4:] != string([]byte{byte(client.Addr().Port >> 8), byte(client.Addr().Port)}) {
+		t.Errorf("Expected the implied port to be stored, got %x", peers)
+	}
+}
+
+// A node restarted with its state file should get its ID back and rejoin
+// through the saved nodes without the bootstrap nodes
+func TestDHTState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "dht")
+
+	peer := startDHT(t, nil)
+	go peer.Run()
+	defer peer.Stop()
+
+	d, err := NewDHT("127.0.0.1:0", nil, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Run()
+	if _, err = d.query(peer.Addr(), "ping", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	id := d.id
+	d.Stop()
+
+	// Stopping before rejoining, with nothing in the routing table,
+	// shouldn't lose the saved nodes
+	d, err = NewDHT("127.0.0.1:0", nil, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.saveState()
+	d.conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDHT("127.0.0.1:0", []string{"127.0.0.1:1"}, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	if d.id != id {
+		t.Errorf("Expected the node ID to be restored")
+	}
+	if len(d.cached) != 1 || d.cached[0].addr.String() != peer.Addr().String() {
+		t.Fatalf("Expected the saved node to be loaded, got %v", d.cached)
+	}
+	go d.Run()
+	d.joinDHT()
+	if nodes := d.table.closest(peer.id, 1); len(nodes) != 1 || nodes[0].id != peer.id {
+		t.Errorf("Expected to rejoin through the saved node, got %v", nodes)
+	}
+}
+
+// Once a torrent turns out to be private, new peers shouldn't be told about
+// the DHT
+func TestPeerManagerPrivateDropsDHT(t *testing.T) {
+	pm := NewPeerManager([][]byte{make([]byte, 20)}, diskIOPeerChans{}, serverPeerChans{}, NewTrackerManager(6881).peerChans, metadataPeerChans{})
+	pm.dht = new(DHT)
+	pm.dhtPort = 6881
+	go pm.Run()
+	pm.private <- true
+	pm.Stop()
+	if pm.dht != nil || pm.dhtPort != 0 || pm.newPeer(true).dhtPort != 0 {
+		t.Errorf("Expected the DHT to be forgotten")
+	}
+}
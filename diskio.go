@@ -22,10 +22,75 @@ type diskIOPeerChans struct {
 }
 
 type DiskIO struct {
-	metaInfo MetaInfo
-	files    []*os.File
-	peerChans diskIOPeerChans
-	t        tomb.Tomb
+	metaInfo        MetaInfo
+	v2              *V2Info
+	files           []*os.File
+	peerChans       diskIOPeerChans
+	controllerChans ControllerDiskIOChans
+	verified        chan []bool // Receives the finished pieces once verified at startup
+	finished        []bool
+	stats           Stats
+	statsCh         chan Stats // Receives the transfer stats whenever they change
+	completed       chan bool  // Closed when the last missing piece is written
+	t               tomb.Tomb
+}
+
+// fileRange is a contiguous range of bytes within one file of a torrent
+type fileRange struct {
+	file   int // index into Info.Files, or 0 in single file mode
+	offset int64
+	length int
+}
+
+// pieceRanges returns the ranges of the files that hold a piece, or nil if
+// the piece doesn't exist. Pieces of a v2 only torrent never span files.
+func pieceRanges(m *MetaInfo, v2 *V2Info, index int) (ranges []fileRange) {
+	pieceLength := m.Info.PieceLength
+	if index < 0 || pieceLength <= 0 {
+		return nil
+	}
+	if v2 != nil && m.Info.Pieces == "" {
+		for i, file := range v2.FileTree {
+			n := numPieces(file.Length, pieceLength)
+			if index < n {
+				offset := index * pieceLength
+				length := file.Length - offset
+				if length > pieceLength {
+					length = pieceLength
+				}
+				return []fileRange{{i, int64(offset), length}}
+			}
+			index -= n
+		}
+		return nil
+	}
+
+	lengths := []int{m.Info.Length}
+	if len(m.Info.Files) > 0 {
+		lengths = nil
+		for _, file := range m.Info.Files {
+			lengths = append(lengths, file.Length)
+		}
+	}
+	begin := int64(index) * int64(pieceLength)
+	end := begin + int64(pieceLength)
+	var fileBegin int64
+	for i, length := range lengths {
+		fileEnd := fileBegin + int64(length)
+		if fileEnd > begin && fileBegin < end && length > 0 {
+			offset := begin - fileBegin
+			if offset < 0 {
+				offset = 0
+			}
+			rangeEnd := fileEnd
+			if rangeEnd > end {
+				rangeEnd = end
+			}
+			ranges = append(ranges, fileRange{i, offset, int(rangeEnd - fileBegin - offset)})
+		}
+		fileBegin = fileEnd
+	}
+	return
 }
 
 // checkHash accepts a byte buffer and pieceIndex, computes the SHA-1 hash of
@@ -39,17 +104,176 @@ func (diskio *DiskIO) checkHash(buf []byte, pieceIndex int) bool {
 	return false
 }
 
-// Verify reads in each file and verifies the SHA-1 checksum of each piece.
+// checkPiece verifies a complete piece using its SHA-1 hash, or its merkle
+// hash in a v2 only torrent
+func (diskio *DiskIO) checkPiece(index int, buf []byte) bool {
+	if diskio.metaInfo.Info.Pieces != "" {
+		return diskio.checkHash(buf, index*20)
+	}
+	ranges := pieceRanges(&diskio.metaInfo, diskio.v2, index)
+	if diskio.v2 == nil || len(ranges) != 1 {
+		return false
+	}
+	pieceLength := diskio.metaInfo.Info.PieceLength
+	return diskio.v2.checkMerkleHash(buf, ranges[0].file, int(ranges[0].offset)/pieceLength, pieceLength)
+}
+
+// writePiece verifies a complete piece and writes it to the files that
+// hold it. Peers and web seeds assemble blocks into whole pieces first.
+func (diskio *DiskIO) writePiece(piece Piece) error {
+	ranges := pieceRanges(&diskio.metaInfo, diskio.v2, piece.index)
+	length := 0
+	for _, r := range ranges {
+		length += r.length
+	}
+	if ranges == nil || piece.begin != 0 || len(piece.block) != length {
+		return fmt.Errorf("piece %d has %d bytes at offset %d, expected %d bytes", piece.index, len(piece.block), piece.begin, length)
+	}
+	if !diskio.checkPiece(piece.index, piece.block) {
+		return fmt.Errorf("piece %d failed hash verification", piece.index)
+	}
+
+	pos := 0
+	for _, r := range ranges {
+		// Pad files aren't stored on disk
+		if file := diskio.files[r.file]; file != nil {
+			if _, err := file.WriteAt(piece.block[pos:pos+r.length], r.offset); err != nil {
+				return err
+			}
+		}
+		pos += r.length
+	}
+	return nil
+}
+
+// pieceBytes returns the number of bytes of a piece that are stored on
+// disk, which doesn't include pad files
+func (diskio *DiskIO) pieceBytes(index int) (n int) {
+	for _, r := range pieceRanges(&diskio.metaInfo, diskio.v2, index) {
+		if len(diskio.metaInfo.Info.Files) == 0 || !diskio.metaInfo.Info.Files[r.file].isPad() {
+			n += r.length
+		}
+	}
+	return
+}
+
+// readBlock reads a block of a piece for uploading to a peer
+func (diskio *DiskIO) readBlock(request Request) ([]byte, error) {
+	if request.begin < 0 || request.length <= 0 {
+		return nil, fmt.Errorf("invalid block %d+%d of piece %d", request.begin, request.length, request.index)
+	}
+	block := make([]byte, request.length)
+	end := request.begin + request.length
+	n := 0
+	rangeBegin := 0 // offset of the range within the piece
+	for _, r := range pieceRanges(&diskio.metaInfo, diskio.v2, request.index) {
+		// Read the part of the block that falls within this range
+		from, to := request.begin, end
+		if from < rangeBegin {
+			from = rangeBegin
+		}
+		if to > rangeBegin+r.length {
+			to = rangeBegin + r.length
+		}
+		if from < to {
+			_, err := diskio.readAt(r.file, block[from-request.begin:to-request.begin], r.offset+int64(from-rangeBegin))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			n += to - from
+		}
+		rangeBegin += r.length
+	}
+	if n != request.length {
+		return nil, fmt.Errorf("block %d+%d of piece %d is out of range", request.begin, request.length, request.index)
+	}
+	return block, nil
+}
+
+// sendStats sends the latest transfer stats, replacing any that haven't
+// been received yet
+func (diskio *DiskIO) sendStats() {
+	select {
+	case <-diskio.statsCh:
+	default:
+	}
+	diskio.statsCh <- diskio.stats
+}
+
+// readAt reads from the i'th file at offset. Pad files aren't stored on disk
+// and read as zeros up to their length.
+func (diskio *DiskIO) readAt(i int, buf []byte, offset int64) (int, error) {
+	if diskio.files[i] != nil {
+		return diskio.files[i].ReadAt(buf, offset)
+	}
+	length := int64(diskio.metaInfo.Info.Files[i].Length)
+	if offset >= length {
+		return 0, io.EOF
+	}
+	n := len(buf)
+	if int64(n) > length-offset {
+		n = int(length - offset)
+	}
+	for j := range buf[:n] {
+		buf[j] = 0
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// verifyV2 reads in each file and verifies each piece against the merkle
+// tree of the file. Pieces in a v2 torrent are aligned to file boundaries.
+func (diskio *DiskIO) verifyV2() (finishedPieces []bool) {
+	pieceLength := diskio.metaInfo.Info.PieceLength
+	buf := make([]byte, pieceLength)
+
+	// The file tree doesn't contain the pad files of a hybrid torrent
+	var dataFiles []*os.File
+	for _, file := range diskio.files {
+		if file != nil {
+			dataFiles = append(dataFiles, file)
+		}
+	}
+
+	for i, file := range diskio.v2.FileTree {
+		for piece := 0; piece < numPieces(file.Length, pieceLength); piece++ {
+			fmt.Printf(".")
+			length := pieceLength
+			if remaining := file.Length - piece*pieceLength; remaining < length {
+				length = remaining
+			}
+			n, err := dataFiles[i].ReadAt(buf[:length], int64(piece*pieceLength))
+			if err != nil && err != io.EOF {
+				log.Fatal(err)
+			}
+			// A short read means the piece hasn't been downloaded yet
+			finishedPieces = append(finishedPieces, n == length && diskio.v2.checkMerkleHash(buf[:n], i, piece, pieceLength))
+		}
+	}
+	fmt.Println()
+
+	return finishedPieces
+}
+
+// Verify reads in each file and verifies the SHA-1 checksum of each piece,
+// or its merkle hash for v2 torrents. A hybrid torrent without its piece
+// layers, as fetched for a magnet link, is verified with SHA-1.
 // Return the boolean list pieces that are correct.
 func (diskio *DiskIO) Verify() (finishedPieces []bool) {
 	log.Println("DiskIO : Verify : Started")
 	defer log.Println("DiskIO : Verify : Completed")
 
+	fmt.Printf("Verifying downloaded files")
+	if diskio.v2 != nil && (diskio.metaInfo.Info.Pieces == "" || diskio.v2.hasPieceLayers(diskio.metaInfo.Info.PieceLength)) {
+		return diskio.verifyV2()
+	}
+
 	buf := make([]byte, diskio.metaInfo.Info.PieceLength)
 	var pieceIndex, n int
 	var err error
 
-	fmt.Printf("Verifying downloaded files")
 	if len(diskio.metaInfo.Info.Files) > 0 {
 		// Multiple File Mode
 		var m int
@@ -59,7 +283,7 @@ func (diskio *DiskIO) Verify() (finishedPieces []bool) {
 				// Read from file at offset, up to buf size or
 				// less if last read was incomplete due to EOF
 				fmt.Printf(".")
-				n, err = diskio.files[i].ReadAt(buf[m:], offset)
+				n, err = diskio.readAt(i, buf[m:], offset)
 				if err != nil {
 					if err == io.EOF {
 						// Reached EOF. Increment partial read counter by bytes read
@@ -121,22 +345,19 @@ func checkError(err error) {
 // openOrCreateFile opens the named file or creates it if it doesn't already
 // exist. If successful it returns a file handle that can be used for I/O.
 func openOrCreateFile(name string) (file *os.File) {
-	// Create the file if it doesn't exist
-	if _, err := os.Stat(name); os.IsNotExist(err) {
-		// Create the file and return a handle
-		file, err = os.Create(name)
-		checkError(err)
-	} else {
-		// Open the file and return a handle
-		file, err = os.Open(name)
-		checkError(err)
-	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	checkError(err)
 	return
 }
 
-func NewDiskIO(metaInfo MetaInfo) *DiskIO {
+func NewDiskIO(metaInfo MetaInfo, v2 *V2Info, controllerChans ControllerDiskIOChans) *DiskIO {
 	diskio := new(DiskIO)
 	diskio.metaInfo = metaInfo
+	diskio.v2 = v2
+	diskio.controllerChans = controllerChans
+	diskio.verified = make(chan []bool, 1)
+	diskio.statsCh = make(chan Stats, 1)
+	diskio.completed = make(chan bool)
 	diskio.peerChans.writePiece = make(chan Piece)
 	diskio.peerChans.requestPiece = make(chan RequestPieceDisk)
 	return diskio
@@ -154,9 +375,13 @@ func (diskio *DiskIO) Init() {
 		err := os.Chdir(directory)
 		checkError(err)
 		for _, file := range diskio.metaInfo.Info.Files {
+			if file.isPad() {
+				diskio.files = append(diskio.files, nil)
+				continue
+			}
 			// Create any sub-directories if required
 			if len(file.Path) > 1 {
-				directory = filepath.Join(file.Path[1:]...)
+				directory = filepath.Join(file.Path[:len(file.Path)-1]...)
 				if _, err := os.Stat(directory); os.IsNotExist(err) {
 					err = os.MkdirAll(directory, os.ModeDir|os.ModePerm)
 					checkError(err)
@@ -184,15 +409,64 @@ func (diskio *DiskIO) Run() {
 	defer log.Println("DiskIO : Run : Completed")
 
 	diskio.Init()
-	finishedPieces := diskio.Verify()
-	fmt.Println(finishedPieces)
+	diskio.finished = diskio.Verify()
+	diskio.verified <- append([]bool(nil), diskio.finished...)
+
+	missing := 0
+	for i, finished := range diskio.finished {
+		if !finished {
+			missing++
+			diskio.stats.Left += diskio.pieceBytes(i)
+		}
+	}
+	diskio.sendStats()
 
 	for {
 		select {
 		case piece := <-diskio.peerChans.writePiece:
-			fmt.Println(piece)
+			received := ReceivedPiece{pieceNum: piece.index, peerName: piece.peerName}
+			resultChan := diskio.controllerChans.receivedPiece
+			downloaded := len(piece.block)
+			if err := diskio.writePiece(piece); err != nil {
+				log.Printf("DiskIO : Run : Discarding data from %s: %s\n", piece.peerName, err)
+				resultChan = diskio.controllerChans.failedPiece
+				diskio.stats.Corrupt += downloaded
+			} else {
+				// Pad files are never downloaded, so they don't count
+				downloaded = diskio.pieceBytes(piece.index)
+				if diskio.finished[piece.index] {
+					diskio.stats.Redundant += downloaded
+				} else {
+					diskio.finished[piece.index] = true
+					diskio.stats.Left -= downloaded
+					missing--
+					if missing == 0 {
+						log.Println("DiskIO : Run : Download completed")
+						close(diskio.completed)
+					}
+				}
+			}
+			diskio.stats.Downloaded += downloaded
+			diskio.sendStats()
+			select {
+			case resultChan <- received:
+			case <-diskio.t.Dying():
+				return
+			}
 		case request := <-diskio.peerChans.requestPiece:
-			fmt.Println(request)
+			block, err := diskio.readBlock(request.request)
+			if err != nil {
+				log.Printf("DiskIO : Run : Unable to read a block: %s\n", err)
+				break
+			}
+			diskio.stats.Uploaded += len(block)
+			diskio.sendStats()
+			piece := Piece{index: request.request.index, begin: request.request.begin, block: block}
+			select {
+			case request.responseChan <- piece:
+			case <-diskio.t.Dying():
+				return
+			}
 		case <-diskio.t.Dying():
 			return
 		}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskIOReadBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	torrent := writeWebSeedTorrent(t, dir, "")
+	diskio := NewDiskIO(torrent.metaInfo, nil, ControllerDiskIOChans{})
+	diskio.files = []*os.File{}
+	for _, name := range []string{"a.bin", filepath.Join("sub", "b c.bin")} {
+		f, err := os.Open(filepath.Join(dir, "seed", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		diskio.files = append(diskio.files, f)
+	}
+
+	// The second piece spans both files
+	block, err := diskio.readBlock(Request{index: 1, begin: 3000, length: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block[:616], bytes.Repeat([]byte{'a'}, 616)) || !bytes.Equal(block[616:], bytes.Repeat([]byte{'b'}, 384)) {
+		t.Errorf("Unexpected block contents")
+	}
+	if n := diskio.pieceBytes(2); n != 35000-2*16384 {
+		t.Errorf("Expected the last piece to hold %d bytes but got %d", 35000-2*16384, n)
+	}
+	if _, err = diskio.readBlock(Request{index: 2, begin: 2000, length: 1000}); err == nil {
+		t.Errorf("Expected an error reading past the end of the torrent")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// TorrentSummary describes the contents of a torrent for the info subcommand
+type TorrentSummary struct {
+	InfoHash       string        `json:"info_hash"`
+	InfoHashBase32 string        `json:"info_hash_base32"`
+	InfoHashV2     string        `json:"info_hash_v2,omitempty"`
+	Name           string        `json:"name"`
+	TotalSize      int64         `json:"total_size"`
+	PieceLength    int           `json:"piece_length"`
+	PieceCount     int           `json:"piece_count"`
+	Private        bool          `json:"private"`
+	Files          []FileSummary `json:"files"`
+	AnnounceList   [][]string    `json:"announce_list"`
+	Comment        string        `json:"comment,omitempty"`
+	CreatedBy      string        `json:"created_by,omitempty"`
+	CreationDate   int64         `json:"creation_date,omitempty"`
+}
+
+// FileSummary describes a single file in a torrent and the range of bytes
+// [Start, End) it occupies within the torrent
+type FileSummary struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+}
+
+// Summary returns a TorrentSummary describing the torrent. Pad files are
+// not listed but still count towards the offsets of the files after them.
+func (t *Torrent) Summary() TorrentSummary {
+	info := t.metaInfo.Info
+	s := TorrentSummary{
+		InfoHash:       hex.EncodeToString(t.infoHash),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(t.infoHash),
+		Name:           info.Name,
+		PieceLength:    info.PieceLength,
+		PieceCount:     t.pieceCount(),
+		Private:        info.Private == 1,
+		Files:          []FileSummary{},
+		AnnounceList:   t.metaInfo.AnnounceList,
+		Comment:        t.metaInfo.Comment,
+		CreatedBy:      t.metaInfo.CreatedBy,
+		CreationDate:   int64(t.metaInfo.CreationDate),
+	}
+	if t.infoHashV2 != nil {
+		s.InfoHashV2 = hex.EncodeToString(t.infoHashV2)
+	}
+	if len(s.AnnounceList) == 0 && t.metaInfo.Announce != "" {
+		s.AnnounceList = [][]string{{t.metaInfo.Announce}}
+	}
+
+	var offset int64
+	if len(info.Files) > 0 {
+		for _, file := range info.Files {
+			length := int64(file.Length)
+			if !file.isPad() {
+				s.Files = append(s.Files, FileSummary{path.Join(file.Path...), length, offset, offset + length})
+				s.TotalSize += length
+			}
+			offset += length
+		}
+	} else if info.Length > 0 {
+		s.Files = append(s.Files, FileSummary{info.Name, int64(info.Length), 0, int64(info.Length)})
+		s.TotalSize = int64(info.Length)
+	}
+	return s
+}
+
+// writeSummaryText prints a TorrentSummary in a human readable form
+func writeSummaryText(w io.Writer, s TorrentSummary) {
+	fmt.Fprintf(w, "Name:          %s\n", s.Name)
+	fmt.Fprintf(w, "Info hash:     %s\n", s.InfoHash)
+	fmt.Fprintf(w, "Base32 hash:   %s\n", s.InfoHashBase32)
+	if s.InfoHashV2 != "" {
+		fmt.Fprintf(w, "v2 info hash:  %s\n", s.InfoHashV2)
+	}
+	fmt.Fprintf(w, "Total size:    %d\n", s.TotalSize)
+	fmt.Fprintf(w, "Piece length:  %d\n", s.PieceLength)
+	fmt.Fprintf(w, "Pieces:        %d\n", s.PieceCount)
+	fmt.Fprintf(w, "Private:       %t\n", s.Private)
+	if s.Comment != "" {
+		fmt.Fprintf(w, "Comment:       %s\n", s.Comment)
+	}
+	if s.CreatedBy != "" {
+		fmt.Fprintf(w, "Created by:    %s\n", s.CreatedBy)
+	}
+	if s.CreationDate != 0 {
+		fmt.Fprintf(w, "Creation date: %s\n", time.Unix(s.CreationDate, 0).UTC().Format(time.RFC1123))
+	}
+	fmt.Fprintf(w, "Trackers:\n")
+	for i, tier := range s.AnnounceList {
+		for _, tr := range tier {
+			fmt.Fprintf(w, "  tier %d: %s\n", i, tr)
+		}
+	}
+	fmt.Fprintf(w, "Files:\n")
+	for _, file := range s.Files {
+		fmt.Fprintf(w, "  %s (%d bytes, %d-%d)\n", file.Path, file.Length, file.Start, file.End)
+	}
+}
+
+// infoMain implements the info subcommand
+func infoMain(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s info [--json] <torrent file | URL | magnet URI>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	t, err := loadTorrent(fs.Arg(0), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	summary := t.Summary()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		if err = enc.Encode(summary); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	writeSummaryText(os.Stdout, summary)
+}
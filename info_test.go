@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTorrentSummary(t *testing.T) {
+	name := writeTestTorrent(t, buildHybridTorrent(bytes.Repeat([]byte{'a'}, 20000), []byte("b"), 16384))
+	defer os.Remove(name)
+	torrent, err := ParseTorrentFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrent.metaInfo.Announce = "http://tracker/announce"
+
+	s := torrent.Summary()
+	if s.Name != "hybrid" || s.TotalSize != 20001 || s.PieceCount != 3 || s.InfoHashV2 == "" {
+		t.Errorf("Unexpected summary %+v", s)
+	}
+	if len(s.Files) != 2 {
+		t.Fatalf("Expected pad files to be omitted, got %+v", s.Files)
+	}
+	if s.Files[1].Path != "b.bin" || s.Files[1].Start != 32768 || s.Files[1].End != 32769 {
+		t.Errorf("Expected the second file to start after the pad file, got %+v", s.Files[1])
+	}
+	if len(s.AnnounceList) != 1 || s.AnnounceList[0][0] != "http://tracker/announce" {
+		t.Errorf("Expected the announce URL as the only tier, got %v", s.AnnounceList)
+	}
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	json.Unmarshal(buf, &decoded)
+	if decoded["info_hash"] != s.InfoHash || decoded["piece_count"] != float64(3) {
+		t.Errorf("Unexpected JSON %s", buf)
+	}
+
+	var text bytes.Buffer
+	writeSummaryText(&text, s)
+	if !strings.Contains(text.String(), s.InfoHashBase32) || !strings.Contains(text.String(), "b.bin (1 bytes, 32768-32769)") {
+		t.Errorf("Unexpected text summary:\n%s", text.String())
+	}
+}
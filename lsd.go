@@ -0,0 +1,302 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"launchpad.net/tomb"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Multicast groups that LSD announces are sent to (BEP 14)
+	lsdGroup4 = "239.192.152.143:6771"
+	lsdGroup6 = "[ff15::efc0:988f]:6771"
+	// How often we announce our torrents on the local network
+	lsdInterval = 5 * time.Minute
+	// BEP 14 asks for no more than one announce a minute
+	lsdMinInterval = time.Minute
+	// Each address may send this many announces per second on average
+	lsdRate = 1.0 / 60
+	// and this many at once
+	lsdBurst = 5
+)
+
+// lsdAnnounce is a parsed BT-SEARCH message
+type lsdAnnounce struct {
+	port       uint16
+	infoHashes [][]byte
+	cookie     string
+}
+
+// constructLSDAnnounce builds a BT-SEARCH message for the given group
+func constructLSDAnnounce(group string, port uint16, infoHashes [][]byte, cookie string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group, port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %X\r\n", infoHash)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n\r\n\r\n", cookie)
+	return b.Bytes()
+}
+
+// parseLSDAnnounce parses a BT-SEARCH message. The headers are those of an
+// HTTP request, so they're read with the HTTP parser.
+func parseLSDAnnounce(buf []byte) (announce lsdAnnounce, err error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return
+	}
+	if req.Method != "BT-SEARCH" {
+		err = fmt.Errorf("unexpected method %q", req.Method)
+		return
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		err = fmt.Errorf("invalid port %q", req.Header.Get("Port"))
+		return
+	}
+	announce.port = uint16(port)
+	for _, value := range req.Header["Infohash"] {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(infoHash) != 20 {
+			continue
+		}
+		announce.infoHashes = append(announce.infoHashes, infoHash)
+	}
+	if len(announce.infoHashes) == 0 {
+		err = errors.New("no info hashes")
+		return
+	}
+	announce.cookie = req.Header.Get("Cookie")
+	return announce, nil
+}
+
+// lsdGroup is a multicast group that we announce to and listen on
+type lsdGroup struct {
+	addr   *net.UDPAddr
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+type lsdPeerChans struct {
+	peers chan PeerTuple // Other end is the PeerManager
+}
+
+// LSD finds peers on the local network with Local Service Discovery
+// (BEP 14). Announces are multicast to the IPv4 and IPv6 groups, and
+// announces of other clients for our torrents are passed to the
+// PeerManager.
+type LSD struct {
+	Interval   time.Duration // time between announces, at least lsdMinInterval
+	port       uint16        // port that our peers listen on
+	infoHashes [][]byte
+	cookie     string // identifies our own announces
+	groups     []*lsdGroup
+	peerChans  lsdPeerChans
+	buckets    map[string]*rateBucket // by IP address
+	mutex      sync.Mutex             // guards buckets, which both groups use
+	t          tomb.Tomb
+}
+
+// interfaceAddr returns an address of the interface in the given family.
+// Sending from it makes the multicast go out on that interface.
+func interfaceAddr(ifi *net.Interface, ipv4 bool) (*net.UDPAddr, error) {
+	if ifi == nil {
+		return nil, nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		if ipv4 {
+			return &net.UDPAddr{IP: ipNet.IP}, nil
+		}
+		return &net.UDPAddr{IP: ipNet.IP, Zone: ifi.Name}, nil
+	}
+	return nil, fmt.Errorf("interface %s has no address for the group", ifi.Name)
+}
+
+// joinLSDGroup starts listening on a multicast group
+func joinLSDGroup(network, group string, ifi *net.Interface) (*lsdGroup, error) {
+	addr, err := net.ResolveUDPAddr(network, group)
+	if err != nil {
+		return nil, err
+	}
+	listen, err := net.ListenMulticastUDP(network, ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+	local, err := interfaceAddr(ifi, network == "udp4")
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, local)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return &lsdGroup{addr, listen, send}, nil
+}
+
+// NewLSD returns an LSD for our torrents that announces and listens on the
+// named interface, or on the system's choice of interface if it's empty.
+// Either group may be unavailable, but not both.
+func NewLSD(iface string, port uint16, infoHashes [][]byte) (*LSD, error) {
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return nil, err
+		}
+	}
+	l := new(LSD)
+	l.Interval = lsdInterval
+	l.port = port
+	l.infoHashes = infoHashes
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	l.cookie = hex.EncodeToString(cookie)
+	l.buckets = make(map[string]*rateBucket)
+
+	var err error
+	for _, g := range []struct{ network, group string }{{"udp4", lsdGroup4}, {"udp6", lsdGroup6}} {
+		var group *lsdGroup
+		if group, err = joinLSDGroup(g.network, g.group, ifi); err != nil {
+			log.Printf("LSD : NewLSD : Unable to join %s: %s\n", g.group, err)
+			continue
+		}
+		l.groups = append(l.groups, group)
+	}
+	if len(l.groups) == 0 {
+		return nil, err
+	}
+	return l, nil
+}
+
+// allow applies the rate limit to announces from ip
+func (l *LSD) allow(ip net.IP, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[string(ip.To16())]
+	if !ok {
+		b = &rateBucket{tokens: lsdBurst, last: now}
+		l.buckets[string(ip.To16())] = b
+	}
+	return b.allow(now, lsdRate, lsdBurst)
+}
+
+// handle returns the peer in an announce from addr if it has one of our
+// torrents. Our own announces, which come back to us, are left out.
+func (l *LSD) handle(buf []byte, addr *net.UDPAddr, now time.Time) (peer PeerTuple, ok bool) {
+	announce, err := parseLSDAnnounce(buf)
+	if err != nil || announce.cookie == l.cookie {
+		return
+	}
+	if !l.allow(addr.IP, now) {
+		log.Printf("LSD : handle : Ignoring announce from %s over the rate limit\n", addr.IP)
+		return
+	}
+	for _, infoHash := range announce.infoHashes {
+		for _, ours := range l.infoHashes {
+			if bytes.Equal(infoHash, ours) {
+				return PeerTuple{addr.IP, announce.port}, true
+			}
+		}
+	}
+	return
+}
+
+// announce sends our torrents to each group
+func (l *LSD) announce() {
+	for _, group := range l.groups {
+		msg := constructLSDAnnounce(group.addr.String(), l.port, l.infoHashes, l.cookie)
+		if _, err := group.send.WriteToUDP(msg, group.addr); err != nil {
+			log.Printf("LSD : announce : Unable to announce to %s: %s\n", group.addr, err)
+		}
+	}
+}
+
+// serve reads announces from a group until its connection is closed
+func (l *LSD) serve(group *lsdGroup) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := group.listen.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.t.Dying():
+			default:
+				log.Println("LSD : serve :", err)
+				l.t.Kill(err)
+			}
+			return
+		}
+		if peer, ok := l.handle(buf[:n], addr, time.Now()); ok {
+			select {
+			case l.peerChans.peers <- peer:
+			case <-l.t.Dying():
+				return
+			}
+		}
+	}
+}
+
+// Stop stops this LSD
+func (l *LSD) Stop() error {
+	log.Println("LSD : Stop : Stopping")
+	l.t.Kill(nil)
+	return l.t.Wait()
+}
+
+// Run announces our torrents every Interval and listens for other clients
+// until the LSD is stopped
+func (l *LSD) Run() {
+	log.Println("LSD : Run : Started")
+	defer l.t.Done()
+	defer log.Println("LSD : Run : Completed")
+
+	for _, group := range l.groups {
+		go l.serve(group)
+	}
+	interval := l.Interval
+	if interval < lsdMinInterval {
+		interval = lsdMinInterval
+	}
+	l.announce()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.announce()
+		case <-l.t.Dying():
+			for _, group := range l.groups {
+				group.listen.Close()
+				group.send.Close()
+			}
+			return
+		}
+	}
+}
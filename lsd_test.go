@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounce(t *testing.T) {
+	infoHashes := [][]byte{bytes.Repeat([]byte{0xab}, 20), bytes.Repeat([]byte{0x01}, 20)}
+	msg := constructLSDAnnounce(lsdGroup4, 6881, infoHashes, "c00k1e")
+	announce, err := parseLSDAnnounce(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announce.port != 6881 || announce.cookie != "c00k1e" || len(announce.infoHashes) != 2 || !bytes.Equal(announce.infoHashes[1], infoHashes[1]) {
+		t.Errorf("Unexpected announce %+v", announce)
+	}
+
+	for _, bad := range []string{
+		"BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nInfohash: " + string(bytes.Repeat([]byte("ab"), 20)) + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: abc\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		if _, err = parseLSDAnnounce([]byte(bad)); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLSDHandle(t *testing.T) {
+	ours := bytes.Repeat([]byte{0xab}, 20)
+	l := &LSD{infoHashes: [][]byte{ours}, cookie: "ours", buckets: make(map[string]*rateBucket)}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 6771}
+	now := time.Now()
+
+	if _, ok := l.handle(constructLSDAnnounce(lsdGroup4, 6881, [][]byte{ours}, "ours"), addr, now); ok {
+		t.Errorf("Expected our own announce to be ignored")
+	}
+	if _, ok := l.handle(constructLSDAnnounce(lsdGroup4, 6881, [][]byte{make([]byte, 20)}, "theirs"), addr, now); ok {
+		t.Errorf("Expected an announce for another torrent to be ignored")
+	}
+	peer, ok := l.handle(constructLSDAnnounce(lsdGroup4, 6882, [][]byte{ours}, "theirs"), addr, now)
+	if !ok || !peer.IP.Equal(addr.IP) || peer.Port != 6882 {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+
+	// The announces above used up part of the burst
+	msg := constructLSDAnnounce(lsdGroup4, 6882, [][]byte{ours}, "theirs")
+	for i := 0; i < lsdBurst-2; i++ {
+		l.handle(msg, addr, now)
+	}
+	if _, ok = l.handle(msg, addr, now); ok {
+		t.Errorf("Expected announces over the rate limit to be ignored")
+	}
+	if _, ok = l.handle(msg, addr, now.Add(time.Minute)); !ok {
+		t.Errorf("Expected an announce to be accepted a minute later")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const btihPrefix = "urn:btih:"
+
+// Magnet represents the fields of a magnet URI that are relevant to
+// BitTorrent. Only the info hash is mandatory.
+type Magnet struct {
+	InfoHash    []byte
+	DisplayName string
+	Trackers    []string
+	Peers       []string // host:port, resolved when the torrent is run
+}
+
+// ParseMagnet parses a magnet URI of the form
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>
+// The info hash may be encoded as 40 hex digits or 32 base32 characters.
+func ParseMagnet(uri string) (magnet Magnet, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "magnet" {
+		err = fmt.Errorf("Not a magnet URI: %s", uri)
+		return
+	}
+	params := u.Query()
+
+	for _, xt := range params["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue
+		}
+		magnet.InfoHash, err = decodeInfoHash(xt[len(btihPrefix):])
+		if err != nil {
+			return
+		}
+		break
+	}
+	if magnet.InfoHash == nil {
+		err = errors.New("Magnet URI does not contain a urn:btih info hash")
+		return
+	}
+
+	magnet.DisplayName = params.Get("dn")
+	magnet.Trackers = params["tr"]
+	for _, pe := range params["x.pe"] {
+		if _, _, err := splitPeerAddress(pe); err != nil {
+			// A bad peer address isn't fatal, we can still use the trackers
+			continue
+		}
+		magnet.Peers = append(magnet.Peers, pe)
+	}
+
+	return
+}
+
+// decodeInfoHash decodes a hex or base32 encoded 20 byte info hash
+func decodeInfoHash(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		return hex.DecodeString(s)
+	case 32:
+		return base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	}
+	return nil, fmt.Errorf("Invalid info hash length %d: %s", len(s), s)
+}
+
+// Torrent returns a Torrent session for the magnet. The Info dictionary is
+// left empty and will be downloaded from peers when the Torrent is run.
+func (magnet Magnet) Torrent() (torrent Torrent) {
+	torrent.infoHash = append(torrent.infoHash, magnet.InfoHash...)
+	torrent.metaInfo.Info.Name = magnet.DisplayName
+	if len(magnet.Trackers) > 0 {
+		torrent.metaInfo.Announce = magnet.Trackers[0]
+	}
+	for _, tr := range magnet.Trackers {
+		torrent.metaInfo.AnnounceList = append(torrent.metaInfo.AnnounceList, []string{tr})
+	}
+	torrent.initialPeers = magnet.Peers
+	torrent.peer = make(chan PeerTuple)
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+func TestParseMagnetHex(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=test+file&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.org%3A80&x.pe=10.0.0.1%3A6881"
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0xc1, 0x2f, 0xe1, 0xc0, 0x6b, 0xba, 0x25, 0x4a, 0x9d, 0xc9, 0xf5, 0x19, 0xb3, 0x35, 0xaa, 0x7c, 0x13, 0x67, 0xa8, 0x8a}
+	if !bytes.Equal(m.InfoHash, expected) {
+		t.Errorf("Expected info hash %x but it was %x", expected, m.InfoHash)
+	}
+	if m.DisplayName != "test file" {
+		t.Errorf("Expected display name %q but it was %q", "test file", m.DisplayName)
+	}
+	if len(m.Trackers) != 2 || m.Trackers[1] != "udp://tracker.example.org:80" {
+		t.Errorf("Unexpected trackers %v", m.Trackers)
+	}
+	if len(m.Peers) != 1 || m.Peers[0] != "10.0.0.1:6881" {
+		t.Errorf("Unexpected peers %v", m.Peers)
+	}
+
+	torrent := m.Torrent()
+	if torrent.metaInfo.Announce != m.Trackers[0] || len(torrent.metaInfo.AnnounceList) != 2 {
+		t.Errorf("Trackers weren't copied into the MetaInfo: %v", torrent.metaInfo.AnnounceList)
+	}
+	if torrent.hasInfo() {
+		t.Errorf("Torrent created from a magnet link shouldn't have an Info dictionary")
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoHash[0] != 0xc1 || len(m.InfoHash) != 20 {
+		t.Errorf("Unexpected info hash %x", m.InfoHash)
+	}
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com/file.torrent",
+		"magnet:?dn=no+hash",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("Expected an error parsing %s", uri)
+		}
+	}
+}
+
+func TestMetadataMessageRoundTrip(t *testing.T) {
+	data := []byte("d4:name4:teste")
+	msg := constructMetadataMessage(MetadataData, 3, 40000, data)
+	msgType, piece, totalSize, rest, err := parseMetadataMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != MetadataData || piece != 3 || totalSize != 40000 || !bytes.Equal(rest, data) {
+		t.Errorf("Unexpected message %d %d %d %q", msgType, piece, totalSize, rest)
+	}
+}
+
+func TestMetadataManagerAssemblesAndVerifies(t *testing.T) {
+	info := bytes.Repeat([]byte{'x'}, metadataPieceSize+100)
+	h := sha1.Sum(info)
+	mm := NewMetadataManager(h[:], nil)
+
+	if mm.addPiece(MetadataPiece{"a", 1, len(info), info[metadataPieceSize:]}) != nil {
+		t.Errorf("Metadata shouldn't be complete after one piece")
+	}
+	// Corrupt first piece should cause the manager to start over
+	bad := bytes.Repeat([]byte{'y'}, metadataPieceSize)
+	if mm.addPiece(MetadataPiece{"b", 0, len(info), bad}) != nil {
+		t.Errorf("Corrupt metadata was accepted")
+	}
+	mm.addPiece(MetadataPiece{"a", 0, len(info), info[:metadataPieceSize]})
+	result := mm.addPiece(MetadataPiece{"a", 1, len(info), info[metadataPieceSize:]})
+	if !bytes.Equal(result, info) {
+		t.Errorf("Expected the verified info dictionary to be returned")
+	}
+}
+
+// A peer that reports the wrong size shouldn't stop the pieces of honest
+// peers from being accepted
+func TestMetadataManagerIgnoresWrongSize(t *testing.T) {
+	info := bytes.Repeat([]byte{'x'}, metadataPieceSize+100)
+	h := sha1.Sum(info)
+	mm := NewMetadataManager(h[:], nil)
+
+	liar := MetadataPiece{"liar", 0, metadataPieceSize, bytes.Repeat([]byte{'y'}, metadataPieceSize)}
+	if mm.addPiece(liar) != nil {
+		t.Errorf("Metadata of the wrong size was accepted")
+	}
+	mm.addPiece(MetadataPiece{"a", 0, len(info), info[:metadataPieceSize]})
+	if result := mm.addPiece(MetadataPiece{"a", 1, len(info), info[metadataPieceSize:]}); !bytes.Equal(result, info) {
+		t.Errorf("Expected the info dictionary of the right size to be assembled")
+	}
+	if _, ok := mm.pieces[metadataPieceSize]; ok {
+		t.Errorf("Expected the pieces of the wrong size to be dropped once they failed verification")
+	}
+}
+
+func TestMetadataManagerServesPieces(t *testing.T) {
+	info := bytes.Repeat([]byte{'x'}, metadataPieceSize+100)
+	h := sha1.Sum(info)
+	mm := NewMetadataManager(h[:], info)
+	if !metadataComplete(mm.peerChans.done) {
+		t.Errorf("MetadataManager created with the info dictionary should be complete")
+	}
+	if piece := mm.getPiece(1); piece.totalSize != len(info) || len(piece.data) != 100 {
+		t.Errorf("Unexpected last piece of size %d with total size %d", len(piece.data), piece.totalSize)
+	}
+	if piece := mm.getPiece(2); piece.data != nil {
+		t.Errorf("Out of range piece should have no data")
+	}
+}
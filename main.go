@@ -6,11 +6,17 @@ package main
 
 import (
 	//"errors"
+	"flag"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,14 +32,196 @@ func init() {
 	}
 }
 
+// usage prints the ways tulva can be invoked and exits
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <torrent file | URL | magnet URI>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s create [options] <file | directory>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s info [--json] <torrent file | URL | magnet URI>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s scrape [options] <torrent file | URL | magnet URI>...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s tracker [options]\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// defaultDHTState returns the DHT state file in the home directory
+func defaultDHTState() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".tulva-dht")
+	}
+	return ""
+}
+
+// trackerOptionsFlag implements flag.Value. Each occurrence of the flag
+// adds the announce options for one tracker, parsed once the other flags
+// are known.
+type trackerOptionsFlag []string
+
+func (f *trackerOptionsFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *trackerOptionsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// peerFlag implements flag.Value. Each occurrence of the flag adds a peer
+// to connect to. Host names are resolved once the proxy is known.
+type peerFlag []string
+
+func (f *peerFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *peerFlag) Set(value string) error {
+	if _, _, err := splitPeerAddress(value); err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// splitPeerAddress returns the host and port of a host:port peer address
+func splitPeerAddress(s string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || host == "" || p == 0 {
+		return "", 0, fmt.Errorf("peer %q needs a host and port", s)
+	}
+	return host, uint16(p), nil
+}
+
+// parsePeerAddress returns the peer at host:port, resolving the host if
+// it's a name. Names aren't resolved in proxy-only mode, since the lookup
+// wouldn't go through the proxy.
+func parsePeerAddress(s string, proxy *Proxy) (PeerTuple, error) {
+	host, port, err := splitPeerAddress(s)
+	if err != nil {
+		return PeerTuple{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := proxy.lookupIP(host)
+		if err != nil {
+			return PeerTuple{}, err
+		}
+		if len(ips) == 0 {
+			return PeerTuple{}, fmt.Errorf("no addresses for peer %q", s)
+		}
+		ip = ips[0]
+	}
+	return PeerTuple{ip, port}, nil
+}
+
+// loadTorrent returns the Torrent described by a magnet URI, http(s) URL or
+// torrent filename. URLs are fetched through the proxy if there is one.
+func loadTorrent(arg string, proxy *Proxy) (Torrent, error) {
+	switch {
+	case strings.HasPrefix(arg, "magnet:"):
+		magnet, err := ParseMagnet(arg)
+		if err != nil {
+			return Torrent{}, err
+		}
+		return magnet.Torrent(), nil
+	case strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://"):
+		return FetchTorrent(arg, proxy)
+	}
+	return ParseTorrentFile(arg)
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s: <torrent file>\n", os.Args[0])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "create":
+			createMain(os.Args[2:])
+			return
+		case "info":
+			infoMain(os.Args[2:])
+			return
+		case "scrape":
+			scrapeMain(os.Args[2:])
+			return
+		case "tracker":
+			trackerMain(os.Args[2:])
+			return
+		}
+	}
+	allTiers := flag.Bool("all-tiers", false, "announce to every tier of trackers at once (ignored for private torrents)")
+	proxyURL := flag.String("proxy", "", "connect to trackers and peers through a proxy, given as socks5://[user:password@]host:port or http://[user:password@]host:port")
+	proxyOnly := flag.Bool("proxy-only", false, "never connect directly, even when the proxy can't carry the traffic")
+	var options AnnounceOptions
+	flag.IntVar(&options.NumWant, "numwant", 0, "number of peers to ask trackers for (default the tracker's choice)")
+	flag.StringVar(&options.IP, "ip", "", "`address` to advertise to trackers, when it isn't the one they see")
+	flag.StringVar(&options.IPv4, "ipv4", "", "IPv4 `address` to advertise to trackers (BEP 7)")
+	flag.StringVar(&options.IPv6, "ipv6", "", "IPv6 `address` to advertise to trackers (BEP 7)")
+	flag.BoolVar(&options.NoPeerID, "no-peer-id", false, "tell trackers that peer IDs may be left out of peer lists")
+	flag.BoolVar(&options.NoCompact, "no-compact", false, "ask trackers for peer lists as dictionaries instead of compact strings")
+	noDHT := flag.Bool("no-dht", false, "don't look for peers in the DHT")
+	dhtPort := flag.Int("dht-port", 6881, "UDP `port` for the DHT node")
+	dhtBootstrap := flag.String("dht-bootstrap", strings.Join(defaultDHTBootstrap, ","), "comma separated `addresses` of nodes used to join the DHT")
+	dhtState := flag.String("dht-state", defaultDHTState(), "`file` that keeps the DHT node ID and routing table between runs, empty to start fresh every time")
+	noLSD := flag.Bool("no-lsd", false, "don't look for peers on the local network")
+	lsdInterface := flag.String("lsd-interface", "", "network `interface` for local peer discovery (default the system's choice)")
+	lsdAnnounceInterval := flag.Duration("lsd-interval", lsdInterval, "time between local peer discovery announces, at least a minute")
+	var peers peerFlag
+	flag.Var(&peers, "peer", "`host:port` of a peer to connect to, without needing a tracker (repeatable)")
+	var trackerOptions trackerOptionsFlag
+	flag.Var(&trackerOptions, "tracker-options", "announce options for one tracker as `URL#name=value,...`, using the names of the announce parameters (repeatable)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
 	}
-	t, err := ParseTorrentFile(os.Args[1])
+	// The proxy is needed to fetch a torrent from a URL
+	var proxy *Proxy
+	var err error
+	if *proxyURL != "" {
+		if proxy, err = ParseProxy(*proxyURL, *proxyOnly); err != nil {
+			log.Fatal(err)
+		}
+	} else if *proxyOnly {
+		log.Fatal("-proxy-only requires -proxy")
+	}
+	t, err := loadTorrent(flag.Arg(0), proxy)
 	if err != nil {
 		log.Fatal(err)
 	}
+	t.proxy = proxy
+	t.allTiers = *allTiers
+	t.lsd = !*noLSD
+	t.lsdInterface = *lsdInterface
+	t.lsdInterval = *lsdAnnounceInterval
+	if !*noDHT {
+		t.dhtAddr = ":" + strconv.Itoa(*dhtPort)
+		t.dhtState = *dhtState
+		if *dhtBootstrap != "" {
+			t.dhtBootstrap = strings.Split(*dhtBootstrap, ",")
+		}
+	}
+	if options.IPv4 != "" {
+		if err = validAddress(options.IPv4, 4); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if options.IPv6 != "" {
+		if err = validAddress(options.IPv6, 6); err != nil {
+			log.Fatal(err)
+		}
+	}
+	t.options = options
+	for _, spec := range trackerOptions {
+		announce, options, err := parseTrackerOptions(spec, t.options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if t.urlOptions == nil {
+			t.urlOptions = make(map[string]AnnounceOptions)
+		}
+		t.urlOptions[announce] = options
+	}
 	log.Println("main : main : Started")
 	defer log.Println("main : main : Exiting")
 
@@ -43,6 +231,15 @@ func main() {
 
 	// Launch the torrent
 	go t.Run()
+	for _, addr := range peers {
+		peer, err := parsePeerAddress(addr, proxy)
+		if err == nil {
+			err = t.AddPeer(peer)
+		}
+		if err != nil {
+			log.Println("main : main :", err)
+		}
+	}
 	time.Sleep(60 * time.Second)
 	log.Println("main : sending stop signal")
 	t.Stop()
@@ -0,0 +1,235 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"crypto/sha1"
+	"errors"
+	"launchpad.net/tomb"
+	"log"
+)
+
+// Metadata exchange (BEP 9) message types
+const (
+	MetadataRequest int = iota
+	MetadataData
+	MetadataReject
+)
+
+const (
+	// Size of each piece of the info dictionary exchanged between peers
+	metadataPieceSize = 16384
+	// Refuse to download info dictionaries larger than this
+	maxMetadataSize = 8 * 1024 * 1024
+	// Most different sizes of the info dictionary assembled at once
+	maxMetadataSizes = 4
+	// Extended message ID we assign to ut_metadata in our handshake
+	utMetadataID = 1
+)
+
+// MetadataPiece is sent from the peer to the MetadataManager when it
+// receives a piece of the info dictionary
+type MetadataPiece struct {
+	peerName  string
+	index     int
+	totalSize int
+	data      []byte
+}
+
+// RequestMetadataPiece used by peer for requesting pieces of the info
+// dictionary from the MetadataManager to serve to other peers
+type RequestMetadataPiece struct {
+	index        int
+	responseChan chan MetadataPiece // data is nil if the piece is unavailable
+}
+
+type metadataPeerChans struct {
+	piece   chan MetadataPiece
+	request chan RequestMetadataPiece
+	// Closed by the MetadataManager once the info dictionary is verified
+	done chan struct{}
+}
+
+// MetadataManager assembles the info dictionary from pieces received by
+// peers and verifies it against the info hash
+type MetadataManager struct {
+	infoHash  []byte
+	pieces    map[int][][]byte // pieces of each size that peers report
+	metadata  []byte           // the verified info dictionary
+	peerChans metadataPeerChans
+	info      chan []byte
+	t         tomb.Tomb
+}
+
+// NewMetadataManager creates a MetadataManager for the info hash. If the
+// info dictionary is already known, it is only served to other peers.
+func NewMetadataManager(infoHash []byte, metadata []byte) *MetadataManager {
+	mm := new(MetadataManager)
+	mm.infoHash = infoHash
+	mm.pieces = make(map[int][][]byte)
+	mm.peerChans.piece = make(chan MetadataPiece)
+	mm.peerChans.request = make(chan RequestMetadataPiece)
+	mm.peerChans.done = make(chan struct{})
+	mm.info = make(chan []byte, 1)
+	if metadata != nil {
+		mm.metadata = metadata
+		close(mm.peerChans.done)
+	}
+	return mm
+}
+
+// metadataComplete returns true if the done channel has been closed
+func metadataComplete(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// numMetadataPieces returns the number of pieces an info dictionary of
+// the given size is split into
+func numMetadataPieces(size int) int {
+	return (size + metadataPieceSize - 1) / metadataPieceSize
+}
+
+// constructMetadataMessage builds the payload of a ut_metadata message.
+// The data is appended after the bencoded dictionary for data messages.
+func constructMetadataMessage(msgType int, piece int, totalSize int, data []byte) []byte {
+	dict := map[string]interface{}{"msg_type": msgType, "piece": piece}
+	if msgType == MetadataData {
+		dict["total_size"] = totalSize
+	}
+	var b bytes.Buffer
+	bencode.Marshal(&b, dict)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// parseMetadataMessage parses the payload of a ut_metadata message into its
+// type, piece index, total size and trailing data.
+func parseMetadataMessage(payload []byte) (msgType int, piece int, totalSize int, data []byte, err error) {
+	end, err := bencodeValueEnd(payload, 0)
+	if err != nil {
+		return
+	}
+	m, err := bencode.Decode(bytes.NewReader(payload[:end]))
+	if err != nil {
+		return
+	}
+	dict, ok := m.(map[string]interface{})
+	if !ok {
+		err = errors.New("ut_metadata message is not a dictionary")
+		return
+	}
+	t, ok1 := dict["msg_type"].(int64)
+	p, ok2 := dict["piece"].(int64)
+	if !ok1 || !ok2 {
+		err = errors.New("ut_metadata message is missing msg_type or piece")
+		return
+	}
+	if size, ok := dict["total_size"].(int64); ok {
+		totalSize = int(size)
+	}
+	return int(t), int(p), totalSize, payload[end:], nil
+}
+
+// addPiece stores a piece of the info dictionary. It returns the complete
+// info dictionary once all pieces of the same size have been received and
+// verified. Each size is assembled separately, so that a peer reporting the
+// wrong size can't stop us getting the right one from other peers.
+func (mm *MetadataManager) addPiece(piece MetadataPiece) []byte {
+	size := piece.totalSize
+	if size <= 0 || size > maxMetadataSize {
+		log.Printf("MetadataManager : addPiece : Ignoring invalid metadata size %d from %s\n", size, piece.peerName)
+		return nil
+	}
+	pieces, ok := mm.pieces[size]
+	if !ok {
+		if len(mm.pieces) >= maxMetadataSizes {
+			log.Printf("MetadataManager : addPiece : Ignoring metadata size %d from %s, too many sizes reported\n", size, piece.peerName)
+			return nil
+		}
+		pieces = make([][]byte, numMetadataPieces(size))
+		mm.pieces[size] = pieces
+	}
+	if piece.index < 0 || piece.index >= len(pieces) {
+		log.Printf("MetadataManager : addPiece : Ignoring out of range piece %d from %s\n", piece.index, piece.peerName)
+		return nil
+	}
+	expected := metadataPieceSize
+	if piece.index == len(pieces)-1 {
+		expected = size - piece.index*metadataPieceSize
+	}
+	if len(piece.data) != expected {
+		log.Printf("MetadataManager : addPiece : Piece %d from %s has length %d, expected %d\n", piece.index, piece.peerName, len(piece.data), expected)
+		return nil
+	}
+	pieces[piece.index] = piece.data
+
+	for _, p := range pieces {
+		if p == nil {
+			return nil
+		}
+	}
+	info := bytes.Join(pieces, nil)
+	h := sha1.New()
+	h.Write(info)
+	if !bytes.Equal(h.Sum(nil), mm.infoHash) {
+		log.Printf("MetadataManager : addPiece : %d byte info dictionary does not match info hash, starting over\n", size)
+		delete(mm.pieces, size)
+		return nil
+	}
+	return info
+}
+
+// getPiece returns a piece of the verified info dictionary
+func (mm *MetadataManager) getPiece(index int) MetadataPiece {
+	piece := MetadataPiece{index: index, totalSize: len(mm.metadata)}
+	begin := index * metadataPieceSize
+	if mm.metadata == nil || index < 0 || begin >= len(mm.metadata) {
+		return piece
+	}
+	end := begin + metadataPieceSize
+	if end > len(mm.metadata) {
+		end = len(mm.metadata)
+	}
+	piece.data = mm.metadata[begin:end]
+	return piece
+}
+
+func (mm *MetadataManager) Stop() error {
+	log.Println("MetadataManager : Stop : Stopping")
+	mm.t.Kill(nil)
+	return mm.t.Wait()
+}
+
+func (mm *MetadataManager) Run() {
+	log.Println("MetadataManager : Run : Started")
+	defer mm.t.Done()
+	defer log.Println("MetadataManager : Run : Completed")
+
+	for {
+		select {
+		case piece := <-mm.peerChans.piece:
+			if metadataComplete(mm.peerChans.done) {
+				continue
+			}
+			if info := mm.addPiece(piece); info != nil {
+				log.Printf("MetadataManager : Run : Received %d byte info dictionary\n", len(info))
+				mm.metadata = info
+				close(mm.peerChans.done)
+				mm.info <- info
+			}
+		case request := <-mm.peerChans.request:
+			request.responseChan <- mm.getPiece(request.index)
+		case <-mm.t.Dying():
+			return
+		}
+	}
+}
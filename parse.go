@@ -8,61 +8,319 @@ import (
 	"bytes"
 	"code.google.com/p/bencode-go"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// bencodeValueEnd returns the offset immediately following the bencoded
+// value that starts at buf[i]. It only checks the structure of the value and
+// does not decode it.
+func bencodeValueEnd(buf []byte, i int) (int, error) {
+	if i >= len(buf) {
+		return 0, errors.New("Unexpected end of bencoded data")
+	}
+	switch c := buf[i]; {
+	case c == 'i':
+		end := bytes.IndexByte(buf[i:], 'e')
+		if end < 0 {
+			return 0, errors.New("Unterminated bencoded integer")
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		var err error
+		for i++; i < len(buf) && buf[i] != 'e'; {
+			if i, err = bencodeValueEnd(buf, i); err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(buf) {
+			return 0, errors.New("Unterminated bencoded list or dictionary")
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(buf[i:], ':')
+		if colon < 0 {
+			return 0, errors.New("Malformed bencoded string length")
+		}
+		var n int
+		for _, d := range buf[i : i+colon] {
+			if d < '0' || d > '9' || n > len(buf) {
+				return 0, errors.New("Malformed bencoded string length")
+			}
+			n = n*10 + int(d-'0')
+		}
+		end := i + colon + 1 + n
+		if end > len(buf) {
+			return 0, errors.New("Bencoded string exceeds end of data")
+		}
+		return end, nil
+	default:
+		return 0, fmt.Errorf("Unexpected byte %q in bencoded data", c)
+	}
+}
+
+// bencodeString decodes the bencoded string at buf[i:end]
+func bencodeString(buf []byte, i int, end int) (string, error) {
+	colon := bytes.IndexByte(buf[i:end], ':')
+	if colon < 0 || buf[i] < '0' || buf[i] > '9' {
+		return "", errors.New("Expected a bencoded string")
+	}
+	return string(buf[i+colon+1 : end]), nil
+}
+
+// findInfoDict returns the exact bytes of the info dictionary within a
+// bencoded metainfo file. The info hash must be computed over these bytes
+// rather than a re-encoding of the decoded value, which may differ.
+func findInfoDict(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != 'd' {
+		return nil, errors.New("top level value is not a dictionary")
+	}
+	if _, err := bencodeValueEnd(buf, 0); err != nil {
+		return nil, err
+	}
+	for i := 1; buf[i] != 'e'; {
+		keyEnd, err := bencodeValueEnd(buf, i)
+		if err != nil {
+			return nil, err
+		}
+		key, err := bencodeString(buf, i, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := bencodeValueEnd(buf, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			if buf[keyEnd] != 'd' {
+				return nil, errors.New("info value is not a dictionary")
+			}
+			return buf[keyEnd:valueEnd], nil
+		}
+		i = valueEnd
+	}
+	return nil, errors.New("info dictionary is missing")
+}
+
+const (
+	// Refuse to parse torrents larger than this
+	maxTorrentSize = 32 * 1024 * 1024
+	// Give up on downloading a torrent from a URL after this long
+	fetchTorrentTimeout = 30 * time.Second
+)
+
+// ParseError is returned when a torrent can't be read or decoded. The
+// Source is the filename or URL it came from.
+type ParseError struct {
+	Source string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Unable to parse %s: %v", e.Source, e.Err)
+}
+
+// ValidationError is returned when a torrent file decodes successfully but
+// describes an invalid or unsafe torrent
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid metainfo field %q: %s", e.Field, e.Reason)
+}
+
+func validationErrorf(field string, format string, a ...interface{}) error {
+	return &ValidationError{field, fmt.Sprintf(format, a...)}
+}
+
+// validatePathComponent rejects path components that could be used to
+// escape the download directory
+func validatePathComponent(field string, component string) error {
+	switch {
+	case component == "":
+		return validationErrorf(field, "empty path component")
+	case component == "." || component == "..":
+		return validationErrorf(field, "relative path component %q", component)
+	case strings.ContainsAny(component, "/\\") || filepath.IsAbs(component):
+		return validationErrorf(field, "path component %q contains a path separator", component)
+	}
+	return nil
+}
+
+// Validate checks that the Info dictionary is consistent and safe to use
+// for creating files on disk.
+func (m *MetaInfo) Validate() error {
+	info := &m.Info
+	if err := validatePathComponent("name", info.Name); err != nil {
+		return err
+	}
+	if info.PieceLength <= 0 {
+		return validationErrorf("piece length", "must be positive, got %d", info.PieceLength)
+	}
+	if info.MetaVersion < 0 || info.MetaVersion > 2 {
+		return validationErrorf("meta version", "unsupported version %d", info.MetaVersion)
+	}
+	// The v1 fields are optional in a v2 torrent, its file tree is
+	// validated separately
+	if info.MetaVersion == 2 && info.Pieces == "" && info.Length == 0 && len(info.Files) == 0 {
+		return nil
+	}
+	if len(info.Pieces) == 0 || len(info.Pieces)%20 != 0 {
+		return validationErrorf("pieces", "length %d is not a multiple of 20", len(info.Pieces))
+	}
+
+	// Exactly one of length (single file mode) or files (multiple file
+	// mode) must be present
+	var totalLength int64
+	switch {
+	case info.Length != 0 && len(info.Files) > 0:
+		return validationErrorf("files", "both length and files are present")
+	case len(info.Files) > 0:
+		for i, file := range info.Files {
+			field := fmt.Sprintf("files[%d]", i)
+			if file.Length < 0 {
+				return validationErrorf(field+".length", "must not be negative, got %d", file.Length)
+			}
+			if len(file.Path) == 0 {
+				return validationErrorf(field+".path", "empty path")
+			}
+			for _, component := range file.Path {
+				if err := validatePathComponent(field+".path", component); err != nil {
+					return err
+				}
+			}
+			totalLength += int64(file.Length)
+		}
+	case info.Length > 0:
+		totalLength = int64(info.Length)
+	default:
+		return validationErrorf("length", "must be positive, got %d", info.Length)
+	}
+	if totalLength <= 0 {
+		return validationErrorf("files", "total length must be positive, got %d", totalLength)
+	}
+
+	numPieces := (totalLength + int64(info.PieceLength) - 1) / int64(info.PieceLength)
+	if numPieces != int64(len(info.Pieces)/20) {
+		return validationErrorf("pieces", "%d pieces present, expected %d for %d bytes", len(info.Pieces)/20, numPieces, totalLength)
+	}
+	return nil
+}
+
 // ParseTorrentFile opens the torrent filename specified and parses it,
-// returning a Torrent structure with the MetaInfo and SHA-1 hash of the
-// Info dictionary.
+// returning a Torrent structure with the MetaInfo, the raw Info dictionary
+// and its SHA-1 hash. A *ParseError is returned if the file can't be read or
+// decoded and a *ValidationError if its contents are invalid.
 func ParseTorrentFile(filename string) (torrent Torrent, err error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return Torrent{}, &ParseError{filename, err}
 	}
 	defer file.Close()
+	return parseTorrentReader(filename, file)
+}
 
-	// Decode the file into a generic bencode representation
-	m, err := bencode.Decode(file)
+// ParseTorrent reads a torrent from r and parses it in the same way as
+// ParseTorrentFile. At most maxTorrentSize bytes are read.
+func ParseTorrent(r io.Reader) (torrent Torrent, err error) {
+	return parseTorrentReader("torrent", r)
+}
+
+// ParseTorrentBytes parses a torrent held in memory in the same way as
+// ParseTorrentFile
+func ParseTorrentBytes(buf []byte) (torrent Torrent, err error) {
+	return parseTorrent("torrent", buf)
+}
+
+// FetchTorrent downloads a torrent from an http or https URL, through the
+// proxy if there is one, and parses it in the same way as ParseTorrentFile
+func FetchTorrent(torrentURL string, proxy *Proxy) (torrent Torrent, err error) {
+	client := proxy.HTTPClient(fetchTorrentTimeout)
+	resp, err := client.Get(torrentURL)
 	if err != nil {
-		log.Fatal(err)
+		return Torrent{}, &ParseError{torrentURL, err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Torrent{}, &ParseError{torrentURL, fmt.Errorf("HTTP status %s", resp.Status)}
 	}
-	// WTF?: Understand the next line
-	metaMap, ok := m.(map[string]interface{})
-	if !ok {
-		err = errors.New("Couldn't parse torrent file")
-		return
+	return parseTorrentReader(torrentURL, resp.Body)
+}
+
+// parseTorrentReader reads up to maxTorrentSize bytes from r and parses them
+func parseTorrentReader(source string, r io.Reader) (torrent Torrent, err error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxTorrentSize+1))
+	if err != nil {
+		return Torrent{}, &ParseError{source, err}
 	}
-	infoDict, ok := metaMap["info"]
-	if !ok {
-		err = errors.New("Unable to locate info dict in torrent file")
-		return
+	if len(buf) > maxTorrentSize {
+		return Torrent{}, &ParseError{source, fmt.Errorf("larger than %d bytes", maxTorrentSize)}
 	}
+	return parseTorrent(source, buf)
+}
 
-	// Create an Info dict based on the decoded file
-	var b bytes.Buffer
-	err = bencode.Marshal(&b, infoDict)
+// parseTorrent parses the bencoded torrent in buf. The source describes
+// where it came from for errors and logging.
+func parseTorrent(source string, buf []byte) (torrent Torrent, err error) {
+	// Locate the Info dictionary exactly as it appears in the file
+	info, err := findInfoDict(buf)
 	if err != nil {
-		log.Println(err)
+		return Torrent{}, &ParseError{source, err}
 	}
+	torrent.infoBytes = info
+	torrent.peer = make(chan PeerTuple)
 
 	// Compute the info hash
 	h := sha1.New()
-	h.Write(b.Bytes())
+	h.Write(info)
 	torrent.infoHash = append(torrent.infoHash, h.Sum(nil)...)
 
 	// Populate the metaInfo structure
-	file.Seek(0, 0)
-	err = bencode.Unmarshal(file, &torrent.metaInfo)
+	err = bencode.Unmarshal(bytes.NewReader(buf), &torrent.metaInfo)
 	if err != nil {
-		log.Println(err)
+		return Torrent{}, &ParseError{source, err}
+	}
+	if torrent.webSeeds, err = parseURLList(buf); err != nil {
+		return Torrent{}, &ParseError{source, err}
+	}
+	if torrent.metaInfo.Info.MetaVersion == 2 {
+		if torrent.v2, err = parseV2Info(buf, info); err != nil {
+			return Torrent{}, &ParseError{source, err}
+		}
+		h2 := sha256.Sum256(info)
+		torrent.infoHashV2 = h2[:]
+	}
+	if err = torrent.metaInfo.Validate(); err != nil {
+		return Torrent{}, err
+	}
+	if torrent.v2 != nil {
+		if err = validateV2(&torrent.metaInfo, torrent.v2); err != nil {
+			return Torrent{}, err
+		}
+		if torrent.metaInfo.Info.Pieces == "" {
+			// A v2 only torrent is identified by its truncated v2 info
+			// hash in the handshake and tracker announces
+			setV1Layout(&torrent.metaInfo, torrent.v2)
+			torrent.infoHash = torrent.infoHashV2[:20]
+		} else if err = validateHybrid(&torrent.metaInfo, torrent.v2); err != nil {
+			return Torrent{}, err
+		}
 	}
 
-	// Print a summary about the torrent file 
-	log.Printf("Parse : ParseTorrentFile : Successfully parsed %s", filename)
-	log.Printf("Parse : ParseTorrentFile : Determined that %d pieces exist in the torrent", (len(torrent.metaInfo.Info.Pieces) / 20))
+	// Print a summary about the torrent file
+	log.Printf("Parse : parseTorrent : Successfully parsed %s", source)
+	log.Printf("Parse : parseTorrent : Determined that %d pieces exist in the torrent", torrent.pieceCount())
 
 	return
 }
-
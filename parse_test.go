@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTestTorrent bencodes the metainfo into a temporary file and returns
+// its name
+func writeTestTorrent(t *testing.T, metaInfo interface{}) string {
+	file, err := ioutil.TempFile("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = bencode.Marshal(file, metaInfo); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// bencodeTestTorrent returns the bencoded form of a metainfo structure
+func bencodeTestTorrent(metaInfo interface{}) []byte {
+	var b bytes.Buffer
+	bencode.Marshal(&b, metaInfo)
+	return b.Bytes()
+}
+
+func testInfoDict() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         "test",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("x", 40),
+		"length":       20000,
+	}
+}
+
+func TestParseTorrentFileValid(t *testing.T) {
+	name := writeTestTorrent(t, map[string]interface{}{"announce": "http://tracker/announce", "info": testInfoDict()})
+	defer os.Remove(name)
+
+	torrent, err := ParseTorrentFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrent.infoHash) != 20 || torrent.metaInfo.Info.Length != 20000 {
+		t.Errorf("Unexpected torrent %x %+v", torrent.infoHash, torrent.metaInfo.Info)
+	}
+}
+
+func TestParseTorrentFileParseErrors(t *testing.T) {
+	if _, err := ParseTorrentFile("/nonexistent/file.torrent"); err == nil {
+		t.Errorf("Expected an error opening a missing file")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Errorf("Expected a *ParseError but got %T: %v", err, err)
+	}
+
+	for _, metaInfo := range []interface{}{
+		"not a dictionary",
+		map[string]interface{}{"announce": "http://tracker/announce"},
+		map[string]interface{}{"info": map[string]interface{}{"name": "test", "piece length": "not an integer"}},
+	} {
+		name := writeTestTorrent(t, metaInfo)
+		_, err := ParseTorrentFile(name)
+		os.Remove(name)
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("Expected a *ParseError for %v but got %T: %v", metaInfo, err, err)
+		}
+	}
+}
+
+func TestParseTorrentFileValidationErrors(t *testing.T) {
+	tests := []struct {
+		field  string
+		modify func(info map[string]interface{})
+	}{
+		{"pieces", func(info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 30) }},
+		{"pieces", func(info map[string]interface{}) { info["pieces"] = strings.Repeat("x", 60) }},
+		{"piece length", func(info map[string]interface{}) { info["piece length"] = 0 }},
+		{"length", func(info map[string]interface{}) { info["length"] = -1 }},
+		{"name", func(info map[string]interface{}) { info["name"] = ".." }},
+		{"files", func(info map[string]interface{}) {
+			info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"a"}}}
+		}},
+		{"files[1].path", func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{
+				map[string]interface{}{"length": 10000, "path": []string{"a"}},
+				map[string]interface{}{"length": 10000, "path": []string{"..", "etc", "passwd"}},
+			}
+		}},
+		{"files[0].path", func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"dir", ""}}}
+		}},
+		{"files[0].path", func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{"/etc/passwd"}}}
+		}},
+		{"files[0].path", func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{map[string]interface{}{"length": 20000, "path": []string{}}}
+		}},
+	}
+	for _, test := range tests {
+		info := testInfoDict()
+		test.modify(info)
+		name := writeTestTorrent(t, map[string]interface{}{"info": info})
+		_, err := ParseTorrentFile(name)
+		os.Remove(name)
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("Expected a *ValidationError for %s but got %T: %v", test.field, err, err)
+		} else if verr.Field != test.field {
+			t.Errorf("Expected a validation error for %s but it was for %s: %v", test.field, verr.Field, err)
+		}
+	}
+}
+
+// The info hash must be computed over the info dictionary exactly as it
+// appears in the file, even if its keys aren't sorted or are unknown to us
+func TestParseTorrentFileNonCanonicalInfo(t *testing.T) {
+	info := "d6:lengthi20000e4:name4:test12:piece lengthi16384e6:pieces40:" + strings.Repeat("x", 40) + "1:zi0e1:ai0ee"
+	raw := "d8:announce23:http://tracker/announce4:info" + info + "7:comment4:teste"
+	file, err := ioutil.TempFile("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(raw)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	torrent, err := ParseTorrentFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(torrent.infoBytes, []byte(info)) {
+		t.Errorf("Expected raw info bytes %q but got %q", info, torrent.infoBytes)
+	}
+	h := sha1.Sum([]byte(info))
+	if !bytes.Equal(torrent.infoHash, h[:]) {
+		t.Errorf("Expected info hash %x but got %x", h, torrent.infoHash)
+	}
+}
+
+func TestFindInfoDictErrors(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"le",
+		"d8:announce3:urle",
+		"d4:infoi5ee",
+		"d4:infod4:name",
+		"d4:infod4:name99:teee",
+	} {
+		if _, err := findInfoDict([]byte(raw)); err == nil {
+			t.Errorf("Expected an error for %q", raw)
+		}
+	}
+}
+
+func TestParseTorrentBytesAndReader(t *testing.T) {
+	var b bytes.Buffer
+	bencode.Marshal(&b, map[string]interface{}{"info": testInfoDict()})
+
+	fromBytes, err := ParseTorrentBytes(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromReader, err := ParseTorrent(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromBytes.infoHash, fromReader.infoHash) || fromReader.metaInfo.Info.Name != "test" {
+		t.Errorf("Expected the same torrent from bytes and a reader")
+	}
+
+	_, err = ParseTorrent(bytes.NewReader(make([]byte, maxTorrentSize+1)))
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("Expected a *ParseError for an oversized torrent but got %v", err)
+	}
+}
+
+func TestFetchTorrent(t *testing.T) {
+	var b bytes.Buffer
+	bencode.Marshal(&b, map[string]interface{}{"info": testInfoDict()})
+	hosts := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		if r.URL.Path != "/test.torrent" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b.Bytes())
+	}))
+	defer ts.Close()
+
+	torrent, err := FetchTorrent(ts.URL+"/test.torrent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.metaInfo.Info.Name != "test" {
+		t.Errorf("Unexpected torrent %+v", torrent.metaInfo.Info)
+	}
+
+	_, err = FetchTorrent(ts.URL+"/missing.torrent", nil)
+	if perr, ok := err.(*ParseError); !ok || perr.Source != ts.URL+"/missing.torrent" {
+		t.Errorf("Expected a *ParseError for a missing torrent but got %v", err)
+	}
+
+	// The test server stands in for an HTTP proxy too
+	proxy, err := ParseProxy(ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-hosts
+	<-hosts
+	if _, err = FetchTorrent("http://torrent.invalid/test.torrent", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if host := <-hosts; host != "torrent.invalid" {
+		t.Errorf("Expected the torrent to be fetched through the proxy, got a request for %s", host)
+	}
+}
+
+func TestPrivateTorrentPeerSources(t *testing.T) {
+	info := testInfoDict()
+	info["private"] = 1
+	torrent, err := ParseTorrentBytes(bencodeTestTorrent(map[string]interface{}{"info": info}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !torrent.isPrivate() {
+		t.Fatalf("Expected the torrent to be private")
+	}
+	for _, source := range []PeerSource{PeerSourceMagnet, PeerSourceDHT, PeerSourcePEX, PeerSourceLSD} {
+		if torrent.allowsPeerSource(source) {
+			t.Errorf("Private torrent shouldn't allow peer source %d", source)
+		}
+	}
+	if !torrent.allowsPeerSource(PeerSourceTracker) || !torrent.allowsPeerSource(PeerSourceUser) {
+		t.Errorf("Private torrent should allow peers from its trackers and the user")
+	}
+
+	// Public until the metadata of a magnet link says otherwise
+	m, _ := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	torrent = m.Torrent()
+	if !torrent.allowsPeerSource(PeerSourceDHT) {
+		t.Errorf("Magnet link without metadata should allow every peer source")
+	}
+	torrent.setInfo(bencodeTestTorrent(info))
+	if torrent.allowsPeerSource(PeerSourceDHT) {
+		t.Errorf("Expected peer sources to be restricted once private metadata arrives")
+	}
+}
@@ -6,15 +6,16 @@ package main
 
 import (
 	"bytes"
+	"code.google.com/p/bencode-go"
 	"encoding/binary"
-	//"errors"
+	"errors"
 	"fmt"
 	"io"
 	"launchpad.net/tomb"
 	"log"
 	"net"
 	"sort"
-	//"strconv"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -35,6 +36,18 @@ const (
 	MsgPort
 )
 
+// Message ID of the extension protocol (BEP 10)
+const MsgExtended = 20
+
+// Reserved bit advertising support for the extension protocol (BEP 10)
+const extensionBit = 0x10
+
+// Reserved bit advertising support for the DHT (BEP 5)
+const dhtBit = 0x01
+
+// Refuse messages longer than this (a piece message carries a 16 KiB block)
+const maxMessageLength = 1 << 20
+
 // PeerTuple represents a single IP+port pair of a peer
 type PeerTuple struct {
 	IP   net.IP
@@ -42,7 +55,7 @@ type PeerTuple struct {
 }
 
 type Peer struct {
-	conn           *net.TCPConn
+	conn           net.Conn
 	amChoking      bool
 	amInterested   bool
 	peerChoking    bool
@@ -55,9 +68,23 @@ type Peer struct {
 	lastTxKeepalive  time.Time
 	lastRxKeepalive  time.Time
 	read           chan []byte
-	infoHash       []byte
+	infoHash       []byte   // info hash sent in our handshake
+	infoHashes     [][]byte // info hashes accepted from the peer
 	diskIOChans    diskIOPeerChans
 	peerManagerChans peerManagerChans
+	metadataChans  metadataPeerChans
+	extensions     bool // peer supports the extension protocol
+	utMetadata     int  // peer's extended message ID for ut_metadata
+	metadataSize   int
+	dhtPort        uint16 // our DHT port, 0 if the DHT is disabled
+	peerDHT        bool   // peer supports the DHT
+	pex            bool   // exchange peers with ut_pex (BEP 11)
+	utPex          int    // peer's extended message ID for ut_pex
+	pexSent        map[string]pexPeer // peers last sent to the peer
+	pexTimer       <-chan time.Time   // fires when the next ut_pex message may be sent
+	port           uint16 // port that we listen on
+	peerPort       uint16 // port that the peer listens on, from its extended handshake
+	peerFlags      byte   // what we know of the peer, as ut_pex flags
 	stats          PeerStats
 	t              tomb.Tomb
 }
@@ -70,16 +97,38 @@ type PeerStats struct {
 
 type PeerManager struct {
 	peers        map[string]*Peer
-	infoHash     []byte
+	infoHashes   [][]byte
 	peerChans    peerManagerChans
 	serverChans  serverPeerChans
 	trackerChans trackerPeerChans
 	diskIOChans  diskIOPeerChans
+	metadataChans metadataPeerChans
+	proxy        *Proxy // outgoing connections go through it
+	dht          *DHT   // nodes learned from port messages are added to it
+	dhtPort      uint16
+	port         uint16 // port that we listen on
+	pex          bool   // cleared once the torrent turns out to be private
+	pexPeers     map[string]pexPeer // connected peers that may be shared, by peer name
+	private      chan bool
 	t            tomb.Tomb
 }
 
 type peerManagerChans struct {
 	deadPeer chan string
+	// Closed when the PeerManager stops reading from deadPeer
+	dying    <-chan struct{}
+	dhtNode  chan *net.UDPAddr
+	// Connected peers that may be shared with other peers
+	connected  chan ConnectedPeer
+	pexRequest chan RequestPexPeers
+	pexAdded   chan PeerTuple
+}
+
+// ConnectedPeer is sent from the peer to the PeerManager once it knows the
+// address that other peers can reach it on
+type ConnectedPeer struct {
+	peerName string
+	peer     pexPeer
 }
 
 type PeerComms struct {
@@ -150,21 +199,30 @@ func sortedPeersByQtyPiecesNeeded(peers map[string]*PeerInfo) SortedPeers {
 	return peerInfoSlice
 }
 
-func NewPeerManager(infoHash []byte, diskIOChans diskIOPeerChans, serverChans serverPeerChans, trackerChans trackerPeerChans) *PeerManager {
+func NewPeerManager(infoHashes [][]byte, diskIOChans diskIOPeerChans, serverChans serverPeerChans, trackerChans trackerPeerChans, metadataChans metadataPeerChans) *PeerManager {
 	pm := new(PeerManager)
-	pm.infoHash = infoHash
+	pm.infoHashes = infoHashes
 	pm.diskIOChans = diskIOChans
 	pm.serverChans = serverChans
 	pm.trackerChans = trackerChans
+	pm.metadataChans = metadataChans
 	pm.peerChans.deadPeer = make(chan string)
+	pm.peerChans.dying = pm.t.Dying()
+	pm.peerChans.dhtNode = make(chan *net.UDPAddr)
+	pm.peerChans.connected = make(chan ConnectedPeer)
+	pm.peerChans.pexRequest = make(chan RequestPexPeers)
+	pm.peerChans.pexAdded = make(chan PeerTuple)
+	pm.pex = true
+	pm.pexPeers = make(map[string]pexPeer)
+	pm.private = make(chan bool)
 	pm.peers = make(map[string]*Peer)
 	return pm
 }
 
-func ConnectToPeer(peerTuple PeerTuple, connCh chan *net.TCPConn) {
+func ConnectToPeer(peerTuple PeerTuple, connCh chan net.Conn, proxy *Proxy) {
 	raddr := net.TCPAddr{peerTuple.IP, int(peerTuple.Port), ""}
 	log.Println("Connecting to", raddr)
-	conn, err := net.DialTCP("tcp4", nil, &raddr)
+	conn, err := proxy.DialTCP(raddr.String())
 	if err != nil {
 		if e, ok := err.(*net.OpError); ok {
 			if e.Err == syscall.ECONNREFUSED {
@@ -172,15 +230,19 @@ func ConnectToPeer(peerTuple PeerTuple, connCh chan *net.TCPConn) {
 				return
 			}
 		}
-		log.Fatal(err)
+		log.Println("ConnectToPeer :", err)
+		return
 	}
 	log.Println("ConnectToPeer : Connected:", raddr)
 	connCh <- conn
 }
 
-func NewPeer(infoHash []byte, initiator bool, diskIOChans diskIOPeerChans) *Peer {
-	p := &Peer{infoHash: infoHash, amChoking: true, amInterested: false, peerChoking: true, peerInterested: false, initiator: initiator, diskIOChans: diskIOChans}
+func NewPeer(infoHashes [][]byte, initiator bool, diskIOChans diskIOPeerChans, peerManagerChans peerManagerChans, metadataChans metadataPeerChans) *Peer {
+	p := &Peer{infoHash: infoHashes[0], infoHashes: infoHashes, amChoking: true, amInterested: false, peerChoking: true, peerInterested: false, initiator: initiator, diskIOChans: diskIOChans}
+	p.peerManagerChans = peerManagerChans
+	p.metadataChans = metadataChans
 	p.read = make(chan []byte)
+	p.pexSent = make(map[string]pexPeer)
 	return p
 }
 
@@ -195,29 +257,61 @@ func constructMessage(id int, payload []byte) (msg []byte, err error) {
 	return
 }
 
+// sendMessage constructs a message with the given ID and payload and writes
+// it to the peer
+func (p *Peer) sendMessage(id int, payload []byte) error {
+	msg, err := constructMessage(id, payload)
+	if err != nil {
+		return err
+	}
+	n, err := p.conn.Write(msg)
+	p.stats.write += n
+	return err
+}
+
+// sendExtended sends an extension protocol message using the extended
+// message ID that the peer assigned in its handshake
+func (p *Peer) sendExtended(extID int, payload []byte) error {
+	return p.sendMessage(MsgExtended, append([]byte{byte(extID)}, payload...))
+}
+
+// Reader reads length prefixed messages from the peer and sends them to the
+// read channel. Keepalives are passed on as empty messages.
 func (p *Peer) Reader() {
 	log.Println("Peer : Reader : Started")
+	defer log.Println("Peer : Reader : Completed")
 
-	buf := make([]byte, 1024)
+	length := make([]byte, 4)
 
 	for {
-		n, err := p.conn.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Reader : EOF:", p.conn.RemoteAddr().String())
+		_, err := io.ReadFull(p.conn, length)
+		if err == nil {
+			n := binary.BigEndian.Uint32(length)
+			if n > maxMessageLength {
+				p.t.Kill(fmt.Errorf("Message length %d from %s is too long", n, p.conn.RemoteAddr().String()))
 				return
-			} else {
-				if e, ok := err.(*net.OpError); ok {
-					if e.Err == syscall.ECONNRESET {
-						log.Println("Reader : Connection Reset:", p.conn.RemoteAddr().String())
-						return
-					}
+			}
+			msg := make([]byte, n)
+			_, err = io.ReadFull(p.conn, msg)
+			p.stats.read += len(msg) + len(length)
+			if err == nil {
+				select {
+				case p.read <- msg:
+				case <-p.t.Dying():
+					return
 				}
-				log.Fatal(err)
+				continue
 			}
 		}
-		fmt.Printf("Read %d bytes\n", n)
-		p.read <- buf
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			log.Println("Reader : EOF:", p.conn.RemoteAddr().String())
+		} else if e, ok := err.(*net.OpError); ok && e.Err == syscall.ECONNRESET {
+			log.Println("Reader : Connection Reset:", p.conn.RemoteAddr().String())
+		} else {
+			log.Println("Reader :", err)
+		}
+		p.t.Kill(err)
+		return
 	}
 }
 
@@ -226,6 +320,10 @@ func (p *Peer) sendHandshake() {
 	defer log.Println("Peer : sendHandshake : Completed")
 
 	reserved := make([]byte, 8)
+	reserved[5] |= extensionBit
+	if p.dhtPort != 0 {
+		reserved[7] |= dhtBit
+	}
 	buf := make([]byte, 0)
 	buf = append(buf, byte(len(pstr)))
 	buf = append(buf, []byte(pstr)...)
@@ -243,41 +341,45 @@ func (p *Peer) receiveHandshake() (error) {
 	log.Println("Peer : receiveHandshake : Started")
 	defer log.Println("Peer : receiveHandshake : Completed")
 
-	buf := make([]byte, 1024)
+	// Read exactly one handshake so that any messages which follow it are
+	// left for the Reader
+	pstrlen := len(pstr)
+	buf := make([]byte, 1+pstrlen+8+20+20)
 	//p.conn.SetReadDeadline(time.Now().Add(time.Second * 1))
-	n, err := p.conn.Read(buf)
+	n, err := io.ReadFull(p.conn, buf)
+	p.stats.read += n
 	if err != nil {
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			log.Println("Reader : EOF:", p.conn.RemoteAddr().String())
-			return err
-		} else {
-			if e, ok := err.(*net.OpError); ok {
-				if e.Err == syscall.ECONNRESET {
-					log.Println("Reader : Connection Reset:", p.conn.RemoteAddr().String())
-					return err
-				}
-			}
-			log.Fatal(err)
+		} else if e, ok := err.(*net.OpError); ok && e.Err == syscall.ECONNRESET {
+			log.Println("Reader : Connection Reset:", p.conn.RemoteAddr().String())
 		}
+		return err
 	}
-	p.stats.read += n
 
-	pstrlen := len(pstr)
 	if (buf[0] != byte(pstrlen)) {
-		pstrerr := fmt.Sprintf("Unexpected length for pstrlen (wanted %d, got %d)", pstrlen, buf[0])
-		log.Fatal(pstrerr)
+		return fmt.Errorf("Unexpected length for pstrlen (wanted %d, got %d)", pstrlen, buf[0])
 	}
 	offset := 1
 	if !bytes.Equal(buf[offset:offset + pstrlen], []byte(pstr)) {
-		pstrerr := fmt.Sprintf("Protocol mismtach: got %s, expected %s", buf[offset:offset + pstrlen], pstr)
-		log.Fatal(pstrerr)
+		return fmt.Errorf("Protocol mismtach: got %s, expected %s", buf[offset:offset + pstrlen], pstr)
 	}
 	offset += pstrlen
-	// ignore reserved bits for now
+	p.extensions = buf[offset+5]&extensionBit != 0
+	p.peerDHT = buf[offset+7]&dhtBit != 0
 	offset += 8
-	if !bytes.Equal(buf[offset:offset + 20], p.infoHash) {
-		pstrerr := fmt.Sprintf("Invalid infoHash: got %x, expected %x", buf[offset:offset + 20], p.infoHash)
-		log.Fatal(pstrerr)
+	// Accept any of our info hashes and reply with the one the peer used
+	infoHash := buf[offset : offset+20]
+	matched := false
+	for _, h := range p.infoHashes {
+		if bytes.Equal(infoHash, h) {
+			p.infoHash = h
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return fmt.Errorf("Invalid infoHash: got %x, expected one of %x", infoHash, p.infoHashes)
 	}
 	offset += 20
 	p.peerID = make([]byte, 20)
@@ -287,43 +389,353 @@ func (p *Peer) receiveHandshake() (error) {
 	return nil
 }
 
-func (p *Peer) doHandshake() {
+func (p *Peer) doHandshake() error {
 	if p.initiator {
 		p.sendHandshake()
-		p.receiveHandshake()
-	} else {
-		p.receiveHandshake()
-		p.sendHandshake()
+		return p.receiveHandshake()
+	}
+	if err := p.receiveHandshake(); err != nil {
+		return err
+	}
+	p.sendHandshake()
+	return nil
+}
+
+// needMetadata returns true if we're still waiting for the info dictionary
+func (p *Peer) needMetadata() bool {
+	return p.metadataChans.done != nil && !metadataComplete(p.metadataChans.done)
+}
+
+// requestMetadataPiece asks the MetadataManager for a piece of the info
+// dictionary. The data is nil if we don't have it.
+func (p *Peer) requestMetadataPiece(index int) (piece MetadataPiece) {
+	if p.metadataChans.request == nil {
+		return
+	}
+	responseChan := make(chan MetadataPiece, 1)
+	select {
+	case p.metadataChans.request <- RequestMetadataPiece{index, responseChan}:
+		piece = <-responseChan
+	case <-p.t.Dying():
+	}
+	return
+}
+
+// sendExtendedHandshake advertises the extensions that we support
+func (p *Peer) sendExtendedHandshake() error {
+	m := map[string]interface{}{"ut_metadata": utMetadataID}
+	if p.pex {
+		m["ut_pex"] = utPexID
+	}
+	handshake := map[string]interface{}{"m": m}
+	if p.port != 0 {
+		handshake["p"] = int(p.port)
+	}
+	if size := p.requestMetadataPiece(0).totalSize; size > 0 {
+		handshake["metadata_size"] = size
+	}
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, handshake); err != nil {
+		return err
+	}
+	return p.sendExtended(0, b.Bytes())
+}
+
+// handleExtended processes an extension protocol message
+func (p *Peer) handleExtended(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("Empty extended message")
+	}
+	switch payload[0] {
+	case 0:
+		return p.handleExtendedHandshake(payload[1:])
+	case utMetadataID:
+		return p.handleMetadataMessage(payload[1:])
+	case utPexID:
+		return p.handlePexMessage(payload[1:])
+	}
+	log.Printf("Peer : handleExtended : Ignoring unknown extended message %d\n", payload[0])
+	return nil
+}
+
+func (p *Peer) handleExtendedHandshake(payload []byte) error {
+	m, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	dict, ok := m.(map[string]interface{})
+	if !ok {
+		return errors.New("Extended handshake is not a dictionary")
+	}
+	if ext, ok := dict["m"].(map[string]interface{}); ok {
+		if id, ok := ext["ut_metadata"].(int64); ok {
+			p.utMetadata = int(id)
+		}
+		if id, ok := ext["ut_pex"].(int64); ok && p.pex {
+			p.utPex = int(id)
+		}
+	}
+	if size, ok := dict["metadata_size"].(int64); ok {
+		p.metadataSize = int(size)
+	}
+	if port, ok := dict["p"].(int64); ok && port > 0 && port <= 65535 {
+		p.peerPort = uint16(port)
+	}
+	if e, _ := dict["e"].(int64); e != 0 {
+		p.peerFlags |= pexEncryption
+	}
+	if uploadOnly, _ := dict["upload_only"].(int64); uploadOnly != 0 {
+		p.peerFlags |= pexSeed
+	}
+	p.reportConnected()
+	if p.utPex != 0 && p.pexTimer == nil {
+		if err := p.sendPex(); err != nil {
+			return err
+		}
+	}
+
+	// Request every piece of the info dictionary if we don't have it yet
+	if p.utMetadata != 0 && p.needMetadata() {
+		if p.metadataSize <= 0 || p.metadataSize > maxMetadataSize {
+			return fmt.Errorf("Invalid metadata_size %d", p.metadataSize)
+		}
+		for i := 0; i < numMetadataPieces(p.metadataSize); i++ {
+			msg := constructMetadataMessage(MetadataRequest, i, 0, nil)
+			if err := p.sendExtended(p.utMetadata, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pexAddress returns the address that other peers can connect to the peer
+// on. It's only known if we connected to the peer, or it told us its port.
+func (p *Peer) pexAddress() (peer pexPeer, ok bool) {
+	host, port, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	if peer.IP = net.ParseIP(host); peer.IP == nil {
+		return
+	}
+	peer.flags = p.peerFlags
+	if p.initiator {
+		n, _ := strconv.Atoi(port)
+		peer.Port = uint16(n)
+		peer.flags |= pexReachable
+	}
+	if p.peerPort != 0 {
+		peer.Port = p.peerPort
+	}
+	return peer, peer.Port != 0
+}
+
+// reportConnected tells the PeerManager how other peers can reach the peer
+func (p *Peer) reportConnected() {
+	peer, ok := p.pexAddress()
+	if !p.pex || !ok {
+		return
+	}
+	select {
+	case p.peerManagerChans.connected <- ConnectedPeer{p.conn.RemoteAddr().String(), peer}:
+	case <-p.t.Dying():
+	}
+}
+
+// sendPex sends the peers that we've connected to or lost since the last
+// ut_pex message. The next one is sent after pexInterval.
+func (p *Peer) sendPex() error {
+	p.pexTimer = time.After(pexInterval)
+	responseChan := make(chan []pexPeer, 1)
+	var current []pexPeer
+	select {
+	case p.peerManagerChans.pexRequest <- RequestPexPeers{responseChan}:
+		current = <-responseChan
+	case <-p.t.Dying():
+		return nil
+	}
+	self, _ := p.pexAddress()
+	added, dropped := pexChanges(p.pexSent, current, self.key())
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+	return p.sendExtended(p.utPex, constructPexMessage(added, dropped))
+}
+
+// handlePexMessage passes the peers added in a ut_pex message on to the
+// PeerManager
+func (p *Peer) handlePexMessage(payload []byte) error {
+	if !p.pex {
+		return nil
+	}
+	peers, err := parsePexMessage(payload)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		select {
+		case p.peerManagerChans.pexAdded <- peer.PeerTuple:
+		case <-p.t.Dying():
+			return nil
+		}
 	}
+	return nil
+}
+
+func (p *Peer) handleMetadataMessage(payload []byte) error {
+	msgType, index, totalSize, data, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	switch msgType {
+	case MetadataRequest:
+		if p.utMetadata == 0 {
+			return nil
+		}
+		piece := p.requestMetadataPiece(index)
+		if piece.data == nil {
+			return p.sendExtended(p.utMetadata, constructMetadataMessage(MetadataReject, index, 0, nil))
+		}
+		return p.sendExtended(p.utMetadata, constructMetadataMessage(MetadataData, index, piece.totalSize, piece.data))
+	case MetadataData:
+		if !p.needMetadata() {
+			return nil
+		}
+		piece := MetadataPiece{peerName: p.conn.RemoteAddr().String(), index: index, totalSize: totalSize, data: data}
+		select {
+		case p.metadataChans.piece <- piece:
+		case <-p.metadataChans.done:
+		case <-p.t.Dying():
+		}
+	case MetadataReject:
+		log.Printf("Peer : handleMetadataMessage : %s rejected request for metadata piece %d\n", p.conn.RemoteAddr().String(), index)
+	}
+	return nil
+}
+
+// handleMessage processes a single message received from the peer
+func (p *Peer) handleMessage(msg []byte) error {
+	if len(msg) == 0 {
+		p.lastRxKeepalive = time.Now()
+		return nil
+	}
+	switch int(msg[0]) {
+	case MsgExtended:
+		return p.handleExtended(msg[1:])
+	case MsgPort:
+		return p.handlePort(msg[1:])
+	}
+	return nil
+}
+
+// sendPort tells the peer which port our DHT node listens on
+func (p *Peer) sendPort() error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, p.dhtPort)
+	return p.sendMessage(MsgPort, payload)
+}
+
+// handlePort passes the peer's DHT node on to the PeerManager
+func (p *Peer) handlePort(payload []byte) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("Invalid port message length %d", len(payload))
+	}
+	if p.dhtPort == 0 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(payload)
+	host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil || port == 0 {
+		return nil
+	}
+	select {
+	case p.peerManagerChans.dhtNode <- &net.UDPAddr{IP: ip, Port: int(port)}:
+	case <-p.t.Dying():
+	}
+	return nil
 }
 
 func (p *Peer) Stop() error {
 	log.Println("Peer : Stop : Stopping")
 	p.t.Kill(nil)
+	// Closing the connection interrupts a handshake in progress
+	p.conn.Close()
 	return p.t.Wait()
 }
 
 func (p *Peer) Run() {
 	log.Println("Peer : Run : Started")
+	defer p.t.Done()
 	defer log.Println("Peer : Run : Completed")
 
-	p.doHandshake()
-	go p.Reader()
+	if err := p.doHandshake(); err != nil {
+		log.Println("Peer : Run : Handshake failed:", err)
+		p.t.Kill(err)
+	} else {
+		if p.extensions {
+			if err := p.sendExtendedHandshake(); err != nil {
+				p.t.Kill(err)
+			}
+		}
+		if p.dhtPort != 0 && p.peerDHT {
+			if err := p.sendPort(); err != nil {
+				p.t.Kill(err)
+			}
+		}
+		if !p.extensions {
+			p.reportConnected()
+		}
+		go p.Reader()
+	}
 
 	for {
 		select {
 		case <-p.keepalive:
-		case <-p.read:
-			fmt.Println("p.read")
-		//case buf := <-p.read:
-			//fmt.Println("Read from peer:", buf)
+		case <-p.pexTimer:
+			if err := p.sendPex(); err != nil {
+				p.t.Kill(err)
+			}
+		case msg := <-p.read:
+			if err := p.handleMessage(msg); err != nil {
+				log.Println("Peer : Run : Error handling message:", err)
+				p.t.Kill(err)
+			}
 		case <-p.t.Dying():
-			p.peerManagerChans.deadPeer <- p.conn.RemoteAddr().String()
+			p.conn.Close()
+			// The PeerManager may be stopping us itself
+			select {
+			case p.peerManagerChans.deadPeer <- p.conn.RemoteAddr().String():
+			case <-p.peerManagerChans.dying:
+			}
 			return
 		}
 	}
 }
 
+// newPeer constructs a Peer for this torrent
+func (pm *PeerManager) newPeer(initiator bool) *Peer {
+	p := NewPeer(pm.infoHashes, initiator, pm.diskIOChans, pm.peerChans, pm.metadataChans)
+	if pm.dht != nil {
+		p.dhtPort = pm.dhtPort
+	}
+	p.pex = pm.pex
+	p.port = pm.port
+	return p
+}
+
+// addPeer connects to a peer that we aren't connected to yet
+func (pm *PeerManager) addPeer(peer PeerTuple) {
+	peerID := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
+	_, ok := pm.peers[peerID]
+	if !ok {
+		// Construct the Peer object
+		pm.peers[peerID] = pm.newPeer(true)
+		go ConnectToPeer(peer, pm.serverChans.conns, pm.proxy)
+	}
+}
+
 func (pm *PeerManager) Stop() error {
 	log.Println("PeerManager : Stop : Stopping")
 	pm.t.Kill(nil)
@@ -338,28 +750,63 @@ func (pm *PeerManager) Run() {
 	for {
 		select {
 		case peer := <-pm.trackerChans.peers:
-			peerID := fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port)
-			_, ok := pm.peers[peerID]
-			if !ok {
-				// Construct the Peer object
-				pm.peers[peerID] = NewPeer(pm.infoHash, true, pm.diskIOChans)
-				go ConnectToPeer(peer, pm.serverChans.conns)
+			pm.addPeer(peer)
+		case peer := <-pm.peerChans.pexAdded:
+			if pm.pex {
+				pm.addPeer(peer)
+			}
+		case c := <-pm.peerChans.connected:
+			if pm.pex {
+				pm.pexPeers[c.peerName] = c.peer
+			}
+		case req := <-pm.peerChans.pexRequest:
+			var peers []pexPeer
+			if pm.pex {
+				for _, peer := range pm.pexPeers {
+					peers = append(peers, peer)
+				}
 			}
+			req.responseChan <- peers
+		case <-pm.private:
+			log.Println("PeerManager : Run : Private torrent, no longer exchanging peers")
+			pm.pex = false
+			pm.pexPeers = make(map[string]pexPeer)
+			// New peers aren't told about the DHT, which is being stopped
+			pm.dht = nil
+			pm.dhtPort = 0
 		case conn := <-pm.serverChans.conns:
 			_, ok := pm.peers[conn.RemoteAddr().String()]
 			if !ok {
 				// Construct the Peer object
-				pm.peers[conn.RemoteAddr().String()] = NewPeer(pm.infoHash, false, pm.diskIOChans)
+				pm.peers[conn.RemoteAddr().String()] = pm.newPeer(false)
 			}
 			// Associate the connection with the peer object and start the peer
 			pm.peers[conn.RemoteAddr().String()].conn = conn
 			go pm.peers[conn.RemoteAddr().String()].Run()
+		case announce := <-pm.trackerChans.switched:
+			log.Printf("PeerManager : Run : Switched to tracker %s, disconnecting from all peers\n", announce)
+			for peerID, peer := range pm.peers {
+				if peer.conn == nil {
+					// Never connected, so it won't report itself dead
+					delete(pm.peers, peerID)
+					continue
+				}
+				peer.t.Kill(nil)
+			}
+		case addr := <-pm.peerChans.dhtNode:
+			if pm.dht != nil {
+				pm.dht.AddNode(addr)
+			}
 		case peer := <-pm.peerChans.deadPeer:
 			log.Printf("PeerManager : Deleting peer %s\n", peer)
 			delete(pm.peers, peer)
+			delete(pm.pexPeers, peer)
 		case <-pm.t.Dying():
 			for _, peer := range pm.peers {
-				peer.Stop()
+				// A peer that never connected was never started
+				if peer.conn != nil {
+					peer.Stop()
+				}
 			}
 			return
 		}
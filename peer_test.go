@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConnPair returns both ends of a TCP connection on the loopback
+// interface
+func testConnPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	theirs, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ours, theirs
+}
+
+// connectTestPeer hands the PeerManager an incoming connection and completes
+// the handshake from the other end, leaving the peer connected
+func connectTestPeer(t *testing.T, pm *PeerManager, conns chan net.Conn) net.Conn {
+	ours, theirs := testConnPair(t)
+	conns <- ours
+	handshake := append([]byte{byte(len(pstr))}, pstr...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, pm.infoHashes[0]...)
+	handshake = append(handshake, PeerID...)
+	if _, err := theirs.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(theirs, make([]byte, len(handshake))); err != nil {
+		t.Fatal(err)
+	}
+	return theirs
+}
+
+// Stopping the PeerManager must not wait forever on peers that are still
+// connected, or that are in the middle of a handshake
+func TestPeerManagerStopsConnectedPeers(t *testing.T) {
+	conns := make(chan net.Conn)
+	pm := NewPeerManager([][]byte{make([]byte, 20)}, diskIOPeerChans{}, serverPeerChans{conns: conns}, NewTrackerManager(6881).peerChans, metadataPeerChans{})
+	go pm.Run()
+	theirs := connectTestPeer(t, pm, conns)
+	defer theirs.Close()
+	ours, stalled := testConnPair(t)
+	defer stalled.Close()
+	conns <- ours
+
+	stopped := make(chan error)
+	go func() { stopped <- pm.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the PeerManager to stop")
+	}
+}
+
+// Peers dropped on a tracker switch report themselves dead, which mustn't
+// block if the PeerManager is stopping at the same time
+func TestPeerManagerStopsAfterSwitch(t *testing.T) {
+	conns := make(chan net.Conn)
+	chans := NewTrackerManager(6881).peerChans
+	pm := NewPeerManager([][]byte{make([]byte, 20)}, diskIOPeerChans{}, serverPeerChans{conns: conns}, chans, metadataPeerChans{})
+	go pm.Run()
+	for i := 0; i < 3; i++ {
+		theirs := connectTestPeer(t, pm, conns)
+		defer theirs.Close()
+	}
+	chans.switched <- "http://tracker/announce"
+
+	stopped := make(chan error)
+	go func() { stopped <- pm.Stop() }()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the PeerManager to stop")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// Extended message ID we assign to ut_pex in our handshake
+	utPexID = 2
+	// Peer lists are sent to each peer at most this often
+	pexInterval = time.Minute
+	// The most peers added or dropped in one message (BEP 11)
+	pexMaxPeers = 50
+)
+
+// Flags describing each added peer in a ut_pex message
+const (
+	pexEncryption = 0x01 // prefers encryption
+	pexSeed       = 0x02 // is a seed or upload only
+	pexReachable  = 0x10 // accepts incoming connections
+)
+
+// pexPeer is a connected peer that we tell other peers about
+type pexPeer struct {
+	PeerTuple
+	flags byte
+}
+
+// key identifies the peer by its address
+func (p pexPeer) key() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// RequestPexPeers is used by a peer to ask the PeerManager for the peers
+// that we're connected to
+type RequestPexPeers struct {
+	responseChan chan []pexPeer
+}
+
+// compactPexPeers returns the IPv4 and IPv6 peers in compact form, along
+// with their flags
+func compactPexPeers(peers []pexPeer) (peers4, flags4, peers6, flags6 []byte) {
+	for _, peer := range peers {
+		port := []byte{byte(peer.Port >> 8), byte(peer.Port)}
+		if ip4 := peer.IP.To4(); ip4 != nil {
+			peers4 = append(append(peers4, ip4...), port...)
+			flags4 = append(flags4, peer.flags)
+		} else if ip6 := peer.IP.To16(); ip6 != nil {
+			peers6 = append(append(peers6, ip6...), port...)
+			flags6 = append(flags6, peer.flags)
+		}
+	}
+	return
+}
+
+// constructPexMessage builds the payload of a ut_pex message
+func constructPexMessage(added, dropped []pexPeer) []byte {
+	added4, flags4, added6, flags6 := compactPexPeers(added)
+	dropped4, _, dropped6, _ := compactPexPeers(dropped)
+	dict := map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(flags4),
+		"added6":   string(added6),
+		"added6.f": string(flags6),
+		"dropped":  string(dropped4),
+		"dropped6": string(dropped6),
+	}
+	var b bytes.Buffer
+	bencode.Marshal(&b, dict)
+	return b.Bytes()
+}
+
+// parsePexMessage returns the peers added in a ut_pex message. Dropped
+// peers are ignored, since we may still be able to reach them.
+func parsePexMessage(payload []byte) ([]pexPeer, error) {
+	m, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("ut_pex message is not a dictionary")
+	}
+	var peers []pexPeer
+	for _, family := range []struct {
+		key   string
+		ipLen int
+	}{{"added", net.IPv4len}, {"added6", net.IPv6len}} {
+		compact, _ := dict[family.key].(string)
+		flags, _ := dict[family.key+".f"].(string)
+		tuples, err := parseCompactPeers(compact, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		for i, tuple := range tuples {
+			peer := pexPeer{PeerTuple: tuple}
+			if i < len(flags) {
+				peer.flags = flags[i]
+			}
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) > pexMaxPeers {
+		peers = peers[:pexMaxPeers]
+	}
+	return peers, nil
+}
+
+// pexChanges compares the peers we're connected to with the ones that were
+// last sent to a peer. It returns the changes to send, leaving out the
+// peer itself, and updates sent to match.
+func pexChanges(sent map[string]pexPeer, current []pexPeer, self string) (added, dropped []pexPeer) {
+	connected := make(map[string]bool)
+	for _, peer := range current {
+		key := peer.key()
+		if key == self {
+			continue
+		}
+		connected[key] = true
+		if _, ok := sent[key]; !ok && len(added) < pexMaxPeers {
+			added = append(added, peer)
+			sent[key] = peer
+		}
+	}
+	for key, peer := range sent {
+		if !connected[key] && len(dropped) < pexMaxPeers {
+			dropped = append(dropped, peer)
+			delete(sent, key)
+		}
+	}
+	return
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPexMessage(t *testing.T) {
+	added := []pexPeer{
+		{PeerTuple{net.IPv4(10, 0, 0, 1), 6881}, pexSeed | pexReachable},
+		{PeerTuple{net.ParseIP("2001:db8::1"), 6882}, pexEncryption | pexSeed},
+	}
+	dropped := []pexPeer{{PeerTuple{net.IPv4(10, 0, 0, 2), 6883}, 0}}
+	peers, err := parsePexMessage(constructPexMessage(added, dropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 added peers, got %v", peers)
+	}
+	for i, peer := range peers {
+		if !peer.IP.Equal(added[i].IP) || peer.Port != added[i].Port || peer.flags != added[i].flags {
+			t.Errorf("Expected peer %v, got %v", added[i], peer)
+		}
+	}
+
+	if _, err = parsePexMessage([]byte("d5:added5:12345e")); err == nil {
+		t.Errorf("Expected a truncated peer list to be rejected")
+	}
+}
+
+func TestPexChanges(t *testing.T) {
+	a := pexPeer{PeerTuple{net.IPv4(10, 0, 0, 1), 6881}, 0}
+	b := pexPeer{PeerTuple{net.IPv4(10, 0, 0, 2), 6881}, 0}
+	self := pexPeer{PeerTuple{net.IPv4(10, 0, 0, 3), 6881}, 0}
+	sent := make(map[string]pexPeer)
+
+	added, dropped := pexChanges(sent, []pexPeer{a, b, self}, self.key())
+	if len(added) != 2 || len(dropped) != 0 {
+		t.Errorf("Expected both other peers to be added, got %v and %v", added, dropped)
+	}
+	added, dropped = pexChanges(sent, []pexPeer{a, self}, self.key())
+	if len(added) != 0 || len(dropped) != 1 || dropped[0].key() != b.key() {
+		t.Errorf("Expected the lost peer to be dropped, got %v and %v", added, dropped)
+	}
+	added, dropped = pexChanges(sent, []pexPeer{a, self}, self.key())
+	if len(added) != 0 || len(dropped) != 0 {
+		t.Errorf("Expected no changes, got %v and %v", added, dropped)
+	}
+}
+
+// Peers learned from ut_pex should only reach the PeerManager while PEX is
+// allowed
+func TestPeerHandlesPexMessage(t *testing.T) {
+	chans := peerManagerChans{pexAdded: make(chan PeerTuple, 1)}
+	p := NewPeer([][]byte{make([]byte, 20)}, true, diskIOPeerChans{}, chans, metadataPeerChans{})
+	msg := constructPexMessage([]pexPeer{{PeerTuple{net.IPv4(10, 0, 0, 1), 6881}, 0}}, nil)
+
+	if err := p.handlePexMessage(msg); err != nil || len(chans.pexAdded) != 0 {
+		t.Errorf("Expected ut_pex to be ignored while PEX is disabled (%v)", err)
+	}
+	p.pex = true
+	if err := p.handlePexMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if peer := <-chans.pexAdded; peer.Port != 6881 || !peer.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+}
@@ -6,9 +6,10 @@ package main
 
 // Piece represents a piece number and data
 type Piece struct {
-	index int
-	begin int
-	block []byte
+	index    int
+	begin    int
+	block    []byte
+	peerName string // the peer or web seed that the data came from
 }
 
 type Request struct {
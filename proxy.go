@@ -0,0 +1,425 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Give up on connecting through a proxy after this long
+const proxyTimeout = 30 * time.Second
+
+// SOCKS5 (RFC 1928, RFC 1929) constants
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+
+	socksConnect      = 1
+	socksUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+var errProxyOnly = errors.New("direct connections are disabled in proxy-only mode")
+
+// Proxy relays tracker and peer connections through a SOCKS5 or HTTP
+// CONNECT proxy. A nil *Proxy connects directly.
+type Proxy struct {
+	URL  *url.URL // socks5://[user:password@]host:port or http://[user:password@]host:port
+	Only bool     // refuse to connect directly when the proxy can't carry the traffic
+}
+
+// ParseProxy returns the Proxy described by a URL
+func ParseProxy(proxyURL string, only bool) (*Proxy, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol %q", u.Scheme)
+	}
+	if _, _, err = net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("proxy address %q: %s", u.Host, err)
+	}
+	return &Proxy{URL: u, Only: only}, nil
+}
+
+// allowsDirect returns true if traffic that the proxy can't carry may be
+// sent directly
+func (p *Proxy) allowsDirect() bool {
+	return p == nil || !p.Only
+}
+
+// proxyAddr is the address of the other end of a proxied connection. It
+// may be a host name that only the proxy resolves.
+type proxyAddr struct {
+	network string
+	addr    string
+}
+
+func (a proxyAddr) Network() string { return a.network }
+func (a proxyAddr) String() string  { return a.addr }
+
+// proxiedConn is a connection through a proxy that reports the address it
+// was relayed to rather than the proxy's
+type proxiedConn struct {
+	net.Conn
+	remote proxyAddr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// DialTCP opens a TCP connection to addr through the proxy
+func (p *Proxy) DialTCP(addr string) (net.Conn, error) {
+	if p == nil {
+		return net.DialTimeout("tcp", addr, proxyTimeout)
+	}
+	conn, err := net.DialTimeout("tcp", p.URL.Host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if p.URL.Scheme == "http" {
+		err = p.httpConnect(conn, addr)
+	} else {
+		_, err = p.socksRequest(conn, socksConnect, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %s", p.URL.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return &proxiedConn{conn, proxyAddr{"tcp", addr}}, nil
+}
+
+// HTTPClient returns a client whose requests go through the proxy
+func (p *Proxy) HTTPClient(timeout time.Duration) *http.Client {
+	if p == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	transport := &http.Transport{}
+	if p.URL.Scheme == "http" {
+		transport.Proxy = http.ProxyURL(p.URL)
+	} else {
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return p.DialTCP(addr)
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// lookupIP resolves a host name, unless that would reveal which hosts we
+// talk to because direct connections are disabled
+func (p *Proxy) lookupIP(host string) ([]net.IP, error) {
+	if !p.allowsDirect() {
+		return nil, fmt.Errorf("not resolving %s locally in proxy-only mode", host)
+	}
+	return net.LookupIP(host)
+}
+
+// DialUDP returns a connection for exchanging datagrams with addr. A SOCKS5
+// proxy relays them with UDP ASSOCIATE. An HTTP proxy can't relay UDP, so
+// the connection is direct unless that isn't allowed.
+func (p *Proxy) DialUDP(addr string) (net.Conn, error) {
+	if p != nil && p.URL.Scheme == "socks5" {
+		return p.socksUDPAssociate(addr)
+	}
+	if !p.allowsDirect() {
+		return nil, errProxyOnly
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, udpAddr)
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to addr. The response is
+// read a byte at a time so none of the tunnelled data is consumed.
+func (p *Proxy) httpConnect(conn net.Conn, addr string) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user := p.URL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return err
+	}
+
+	var buf []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		if len(buf) > 4096 {
+			return errors.New("CONNECT response is too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		buf = append(buf, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socksAuthenticate negotiates an authentication method with a SOCKS5
+// proxy, and sends the username and password if it asks for them
+func (p *Proxy) socksAuthenticate(conn net.Conn) error {
+	methods := []byte{socksAuthNone}
+	if p.URL.User != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if p.URL.User == nil {
+			return errors.New("SOCKS proxy requires a username and password")
+		}
+	default:
+		return errors.New("SOCKS proxy refused every authentication method")
+	}
+
+	username := p.URL.User.Username()
+	password, _ := p.URL.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS username or password is too long")
+	}
+	auth := []byte{1, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := conn.Write(auth); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("SOCKS proxy rejected the username and password")
+	}
+	return nil
+}
+
+// socksAddress encodes an address in the form used by SOCKS5 requests and
+// UDP datagrams
+func socksAddress(addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q is too long", host)
+		}
+		b = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAddrIPv6}, ip...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readSOCKSAddress reads an address in the SOCKS5 form
+func readSOCKSAddress(r io.Reader) (string, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	var host string
+	switch b[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if b[0] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		name := make([]byte, b[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown SOCKS address type %d", b[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksRequest authenticates with a SOCKS5 proxy and sends it a command.
+// It returns the address that the proxy bound for the command.
+func (p *Proxy) socksRequest(conn net.Conn, command byte, addr string) (string, error) {
+	if err := p.socksAuthenticate(conn); err != nil {
+		return "", err
+	}
+	dest, err := socksAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(append([]byte{socksVersion, command, 0}, dest...)); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 3)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion {
+		return "", fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		if int(reply[1]) < len(socksReplies) {
+			return "", errors.New(socksReplies[reply[1]])
+		}
+		return "", fmt.Errorf("SOCKS error %d", reply[1])
+	}
+	return readSOCKSAddress(conn)
+}
+
+// socksUDPConn exchanges datagrams with one address through a SOCKS5 UDP
+// relay. The relay is kept open for as long as the control connection.
+type socksUDPConn struct {
+	*net.UDPConn
+	control net.Conn
+	header  []byte // prepended to each datagram
+	remote  proxyAddr
+}
+
+// socksUDPAssociate asks the proxy to relay datagrams to addr
+func (p *Proxy) socksUDPAssociate(addr string) (net.Conn, error) {
+	header, err := socksAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	control, err := net.DialTimeout("tcp", p.URL.Host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	control.SetDeadline(time.Now().Add(proxyTimeout))
+	// The address and port the datagrams will come from aren't known yet
+	relay, err := p.socksRequest(control, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("proxy %s: %s", p.URL.Host, err)
+	}
+	control.SetDeadline(time.Time{})
+
+	relayAddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if relayAddr.IP.IsUnspecified() {
+		// The relay is on the proxy itself
+		relayAddr.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	header = append([]byte{0, 0, 0}, header...)
+	return &socksUDPConn{conn, control, header, proxyAddr{"udp", addr}}, nil
+}
+
+// Write sends a datagram through the relay
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	if _, err := c.UDPConn.Write(append(append([]byte(nil), c.header...), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read receives a datagram from the relay without its SOCKS header.
+// Fragmented datagrams are dropped.
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err = readSOCKSAddress(r); err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), nil
+	}
+}
+
+func (c *socksUDPConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
+
+func (c *socksUDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
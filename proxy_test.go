@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// socksTestProxy is a stand-in SOCKS5 proxy supporting CONNECT and UDP
+// ASSOCIATE with optional username and password authentication
+type socksTestProxy struct {
+	ln       net.Listener
+	username string
+	password string
+	mutex    sync.Mutex
+	requests int
+}
+
+func newSOCKSTestProxy(t *testing.T, username, password string) *socksTestProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksTestProxy{ln: ln, username: username, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksTestProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, buf[1])
+	io.ReadFull(conn, methods)
+	if s.username == "" {
+		conn.Write([]byte{socksVersion, socksAuthNone})
+	} else {
+		if bytes.IndexByte(methods, socksAuthPassword) < 0 {
+			conn.Write([]byte{socksVersion, 0xff})
+			return
+		}
+		conn.Write([]byte{socksVersion, socksAuthPassword})
+		io.ReadFull(conn, buf)
+		username := make([]byte, buf[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(conn, password)
+		if string(username) != s.username || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	addr, err := readSOCKSAddress(conn)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	s.requests++
+	s.mutex.Unlock()
+
+	switch request[1] {
+	case socksConnect:
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{socksVersion, 0, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	case socksUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		bound, _ := socksAddress(relay.LocalAddr().String())
+		conn.Write(append([]byte{socksVersion, 0, 0}, bound...))
+		go s.relay(relay)
+		// The association ends with the control connection
+		io.Copy(ioutil.Discard, conn)
+	default:
+		conn.Write([]byte{socksVersion, 7, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// relay forwards datagrams between the client and the addresses in their
+// headers
+func (s *socksTestProxy) relay(relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			addr, err := readSOCKSAddress(r)
+			if err != nil {
+				continue
+			}
+			dest, _ := net.ResolveUDPAddr("udp", addr)
+			relay.WriteToUDP(buf[n-r.Len():n], dest)
+		} else {
+			header, _ := socksAddress(from.String())
+			relay.WriteToUDP(append(append([]byte{0, 0, 0}, header...), buf[:n]...), client)
+		}
+	}
+}
+
+// newEchoServer returns the address of a TCP server that echoes what it
+// receives
+func newEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// checkEcho makes sure data makes it to the echo server and back
+func checkEcho(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the data to be echoed, got %q (%v)", buf, err)
+	}
+}
+
+func TestSOCKSProxyConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	s := newSOCKSTestProxy(t, "user", "secret")
+	defer s.ln.Close()
+
+	proxy, err := ParseProxy("socks5://user:secret@"+s.ln.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := proxy.DialTCP(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != echo.Addr().String() {
+		t.Errorf("Expected the remote address to be %s, got %s", echo.Addr(), conn.RemoteAddr())
+	}
+	checkEcho(t, conn)
+
+	proxy, _ = ParseProxy("socks5://user:wrong@"+s.ln.Addr().String(), false)
+	if _, err = proxy.DialTCP(echo.Addr().String()); err == nil {
+		t.Errorf("Expected a wrong password to be rejected")
+	}
+	if _, err = ParseProxy("ftp://"+s.ln.Addr().String(), false); err == nil {
+		t.Errorf("Expected an unsupported proxy protocol to be rejected")
+	}
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != "CONNECT" || req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	proxy, _ := ParseProxy("http://user:secret@"+ln.Addr().String(), true)
+	conn, err := proxy.DialTCP(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	proxy.URL.User = nil
+	if _, err = proxy.DialTCP(echo.Addr().String()); err == nil {
+		t.Errorf("Expected the proxy to require authentication")
+	}
+	// An HTTP proxy can't relay UDP
+	if _, err = proxy.DialUDP("127.0.0.1:6969"); err != errProxyOnly {
+		t.Errorf("Expected UDP to be refused in proxy-only mode, got %v", err)
+	}
+}
+
+// Trackers reached over HTTP and UDP should go through the proxy
+func TestSOCKSProxyTrackers(t *testing.T) {
+	s := newSOCKSTestProxy(t, "", "")
+	defer s.ln.Close()
+	proxy, _ := ParseProxy("socks5://"+s.ln.Addr().String(), true)
+
+	ts := newTestTracker("d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	defer ts.Close()
+	u := newUDPTestTracker(t)
+	defer u.conn.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL}}, false)
+	tr.proxy = proxy
+	tr.client = proxy.HTTPClient(trackerTimeout)
+	go tr.Announce(Started)
+	if peer := receivePeer(t, chans); peer.Port != 6881 {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+
+	if err := tr.announce(u.url(), Started); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.udpClients[u.url().Host].Close()
+	if len(tr.peers) != 1 || tr.peers[0].Port != 6881 {
+		t.Errorf("Unexpected peers from the UDP tracker %v", tr.peers)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.requests != 2 {
+		t.Errorf("Expected both trackers to be reached through the proxy, got %d requests", s.requests)
+	}
+}
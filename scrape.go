@@ -0,0 +1,323 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The most info hashes to send in a single scrape request. BEP 15 allows
+// up to 74, HTTP trackers are limited by the length of the URL.
+const (
+	maxUDPScrapeHashes  = 74
+	maxHTTPScrapeHashes = 50
+)
+
+// Each tracker is given this long to answer all of its scrape requests
+var scrapeTimeout = trackerTimeout
+
+// ScrapeResult holds the statistics a tracker reports for one info hash
+type ScrapeResult struct {
+	Complete   int `json:"complete"`   // seeders
+	Downloaded int `json:"downloaded"` // number of times the torrent was completed
+	Incomplete int `json:"incomplete"` // leechers
+}
+
+// TrackerScrape is the result of scraping one tracker for a torrent
+type TrackerScrape struct {
+	Announce string `json:"announce"`
+	ScrapeResult
+	Error string `json:"error,omitempty"`
+}
+
+// scrapeURL returns the scrape URL of an HTTP tracker. By convention it
+// replaces announce in the last path component of the announce URL, and
+// trackers without announce there don't support scraping.
+func scrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", errors.New("tracker does not support scrape")
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	return u.String(), nil
+}
+
+// scrapeHTTP scrapes an HTTP tracker for the given info hashes at once
+func scrapeHTTP(ctx context.Context, client *http.Client, scrape string, infoHashes [][]byte) (map[string]ScrapeResult, error) {
+	u, err := url.Parse(scrape)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash))
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("scrape response is not a dictionary")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, trackerFailure(reason)
+	}
+	files, _ := dict["files"].(map[string]interface{})
+	results := make(map[string]ScrapeResult)
+	for infoHash, file := range files {
+		stats, ok := file.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("scrape result for %x is not a dictionary", infoHash)
+		}
+		complete, _ := stats["complete"].(int64)
+		downloaded, _ := stats["downloaded"].(int64)
+		incomplete, _ := stats["incomplete"].(int64)
+		results[infoHash] = ScrapeResult{int(complete), int(downloaded), int(incomplete)}
+	}
+	return results, nil
+}
+
+// ScrapeTracker asks a tracker for the statistics of each info hash, in as
+// few requests as the protocol allows. The results are keyed by info hash.
+// The tracker has scrapeTimeout to answer all of the requests, which go
+// through the proxy if there is one.
+func ScrapeTracker(announce string, infoHashes [][]byte, proxy *Proxy) (map[string]ScrapeResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]ScrapeResult)
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	switch u.Scheme {
+	case "udp":
+		client, err := newUDPTrackerClient(u.Host, proxy)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+		for len(infoHashes) > 0 {
+			n := len(infoHashes)
+			if n > maxUDPScrapeHashes {
+				n = maxUDPScrapeHashes
+			}
+			batch, err := client.scrape(ctx, infoHashes[:n])
+			if err != nil {
+				return nil, err
+			}
+			for i, result := range batch {
+				results[string(infoHashes[i])] = result
+			}
+			infoHashes = infoHashes[n:]
+		}
+	case "http", "https":
+		scrape, err := scrapeURL(announce)
+		if err != nil {
+			return nil, err
+		}
+		client := proxy.HTTPClient(trackerTimeout)
+		for len(infoHashes) > 0 {
+			n := len(infoHashes)
+			if n > maxHTTPScrapeHashes {
+				n = maxHTTPScrapeHashes
+			}
+			batch, err := scrapeHTTP(ctx, client, scrape, infoHashes[:n])
+			if err != nil {
+				return nil, err
+			}
+			for infoHash, result := range batch {
+				results[infoHash] = result
+			}
+			infoHashes = infoHashes[n:]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+	return results, nil
+}
+
+// scrapeTorrents scrapes every tracker of each torrent. Torrents that share
+// a tracker are scraped together, and the trackers are scraped at the same
+// time, through the proxy if there is one. The results are in the same
+// order as the torrents, and list each tracker in tier order.
+func scrapeTorrents(torrents []*Torrent, proxy *Proxy) [][]TrackerScrape {
+	var announces []string
+	hashes := make(map[string][][]byte)
+	for _, t := range torrents {
+		for _, tier := range announceTiers(t.metaInfo) {
+			for _, announce := range tier {
+				if _, ok := hashes[announce]; !ok {
+					announces = append(announces, announce)
+				}
+				hashes[announce] = append(hashes[announce], t.infoHashes()...)
+			}
+		}
+	}
+
+	type trackerResult struct {
+		results map[string]ScrapeResult
+		err     error
+	}
+	byTracker := make(map[string]trackerResult)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, announce := range announces {
+		wg.Add(1)
+		go func(announce string) {
+			defer wg.Done()
+			results, err := ScrapeTracker(announce, hashes[announce], proxy)
+			if err != nil {
+				log.Printf("Scrape : scrapeTorrents : %s failed: %s\n", announce, err)
+			}
+			mutex.Lock()
+			byTracker[announce] = trackerResult{results, err}
+			mutex.Unlock()
+		}(announce)
+	}
+	wg.Wait()
+
+	scrapes := make([][]TrackerScrape, len(torrents))
+	for i, t := range torrents {
+		seen := make(map[string]bool)
+		for _, tier := range announceTiers(t.metaInfo) {
+			for _, announce := range tier {
+				if seen[announce] {
+					continue
+				}
+				seen[announce] = true
+				scrape := TrackerScrape{Announce: announce}
+				if r := byTracker[announce]; r.err != nil {
+					scrape.Error = r.err.Error()
+				} else {
+					// A hybrid torrent is reported under whichever of its
+					// info hashes has the most seeders
+					for _, infoHash := range t.infoHashes() {
+						if result, ok := r.results[string(infoHash)]; ok && result.Complete >= scrape.Complete {
+							scrape.ScrapeResult = result
+						}
+					}
+				}
+				scrapes[i] = append(scrapes[i], scrape)
+			}
+		}
+	}
+	return scrapes
+}
+
+// Scrape asks each of the torrent's trackers for the number of seeders,
+// leechers and completed downloads without announcing
+func (t *Torrent) Scrape() []TrackerScrape {
+	return scrapeTorrents([]*Torrent{t}, t.proxy)[0]
+}
+
+// writeScrapeText prints the scrape results of a torrent in a human
+// readable form
+func writeScrapeText(w io.Writer, t *Torrent, scrapes []TrackerScrape) {
+	fmt.Fprintf(w, "%s (%x)\n", t.metaInfo.Info.Name, t.infoHash)
+	if len(scrapes) == 0 {
+		fmt.Fprintf(w, "  no trackers\n")
+	}
+	for _, scrape := range scrapes {
+		if scrape.Error != "" {
+			fmt.Fprintf(w, "  %s: error: %s\n", scrape.Announce, scrape.Error)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %d seeders, %d leechers, %d completed\n", scrape.Announce, scrape.Complete, scrape.Incomplete, scrape.Downloaded)
+	}
+}
+
+// scrapeMain implements the scrape subcommand
+func scrapeMain(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	proxyURL := fs.String("proxy", "", "scrape trackers through a proxy, given as socks5://[user:password@]host:port or http://[user:password@]host:port")
+	proxyOnly := fs.Bool("proxy-only", false, "never connect directly, even when the proxy can't carry the traffic")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scrape [options] <torrent file | URL | magnet URI>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var proxy *Proxy
+	var err error
+	if *proxyURL != "" {
+		if proxy, err = ParseProxy(*proxyURL, *proxyOnly); err != nil {
+			log.Fatal(err)
+		}
+	} else if *proxyOnly {
+		log.Fatal("-proxy-only requires -proxy")
+	}
+
+	var torrents []*Torrent
+	for _, arg := range fs.Args() {
+		t, err := loadTorrent(arg, proxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		torrents = append(torrents, &t)
+	}
+	scrapes := scrapeTorrents(torrents, proxy)
+
+	if *asJSON {
+		type torrentScrape struct {
+			Name     string          `json:"name"`
+			InfoHash string          `json:"info_hash"`
+			Trackers []TrackerScrape `json:"trackers"`
+		}
+		var out []torrentScrape
+		for i, t := range torrents {
+			out = append(out, torrentScrape{t.metaInfo.Info.Name, hex.EncodeToString(t.infoHash), scrapes[i]})
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for i, t := range torrents {
+		writeScrapeText(os.Stdout, t, scrapes[i])
+	}
+}
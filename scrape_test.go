@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScrapeURL(t *testing.T) {
+	for announce, expected := range map[string]string{
+		"http://example.com/announce":          "http://example.com/scrape",
+		"http://example.com/x/announce":        "http://example.com/x/scrape",
+		"http://example.com/announce.php":      "http://example.com/scrape.php",
+		"http://example.com/announce?key=abcd": "http://example.com/scrape?key=abcd",
+		"http://example.com/a":                 "",
+		"http://example.com/announce/x":        "",
+	} {
+		scrape, err := scrapeURL(announce)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected %s not to support scrape but got %s", announce, scrape)
+			}
+		} else if scrape != expected {
+			t.Errorf("Expected scrape URL %s for %s but got %s (%v)", expected, announce, scrape, err)
+		}
+	}
+}
+
+func TestScrapeTorrentsBatchesHTTP(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		response := map[string]interface{}{}
+		for i, infoHash := range r.URL.Query()["info_hash"] {
+			response[infoHash] = map[string]interface{}{"complete": 10 + i, "downloaded": 20, "incomplete": 30}
+		}
+		w.Write(bencodeTestTorrent(map[string]interface{}{"files": response}))
+	}))
+	defer ts.Close()
+
+	var torrents []*Torrent
+	for _, name := range []string{"first", "second"} {
+		info := testInfoDict()
+		info["name"] = name
+		torrent, err := ParseTorrentBytes(bencodeTestTorrent(map[string]interface{}{
+			"announce-list": [][]string{{ts.URL + "/announce"}},
+			"info":          info,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		torrents = append(torrents, &torrent)
+	}
+	scrapes := scrapeTorrents(torrents, nil)
+	if requests != 1 {
+		t.Errorf("Expected both torrents to be scraped in one request, got %d", requests)
+	}
+	if len(scrapes) != 2 || len(scrapes[0]) != 1 || len(scrapes[1]) != 1 {
+		t.Fatalf("Unexpected scrapes %+v", scrapes)
+	}
+	if scrapes[0][0].Complete != 10 || scrapes[1][0].Complete != 11 || scrapes[1][0].Incomplete != 30 || scrapes[1][0].Downloaded != 20 {
+		t.Errorf("Unexpected scrapes %+v", scrapes)
+	}
+
+	var b bytes.Buffer
+	writeScrapeText(&b, torrents[1], scrapes[1])
+	if !bytes.Contains(b.Bytes(), []byte("11 seeders, 30 leechers, 20 completed")) {
+		t.Errorf("Unexpected output %q", b.String())
+	}
+}
+
+func TestScrapeTrackerBatchesUDP(t *testing.T) {
+	s := newUDPTestTracker(t)
+	defer s.conn.Close()
+
+	var infoHashes [][]byte
+	for i := 0; i < maxUDPScrapeHashes+6; i++ {
+		infoHashes = append(infoHashes, bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	results, err := ScrapeTracker(s.url().String(), infoHashes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(infoHashes) {
+		t.Fatalf("Expected %d results but got %d", len(infoHashes), len(results))
+	}
+	if result := results[string(infoHashes[maxUDPScrapeHashes+5])]; result.Complete != maxUDPScrapeHashes+5 || result.Downloaded != 9 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if _, scrapes := s.counts(); scrapes != 2 {
+		t.Errorf("Expected 2 scrape requests but got %d", scrapes)
+	}
+}
+
+func TestScrapeTrackerThroughProxy(t *testing.T) {
+	hosts := make(chan string, 1)
+	// The test server stands in for an HTTP proxy
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		w.Write([]byte("d5:filesdee"))
+	}))
+	defer ts.Close()
+	proxy, err := ParseProxy(ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ScrapeTracker("http://tracker.invalid/announce", [][]byte{make([]byte, 20)}, proxy); err != nil {
+		t.Fatal(err)
+	}
+	if host := <-hosts; host != "tracker.invalid" {
+		t.Errorf("Expected the scrape to go through the proxy, got a request for %s", host)
+	}
+	// An HTTP proxy can't relay UDP
+	if _, err = ScrapeTracker("udp://tracker.invalid:80", [][]byte{make([]byte, 20)}, proxy); err != errProxyOnly {
+		t.Errorf("Expected a UDP scrape to be refused in proxy-only mode, got %v", err)
+	}
+}
+
+// A tracker that doesn't answer should only hold up its own results, and
+// only until the timeout
+func TestScrapeTorrentsTimesOut(t *testing.T) {
+	timeout := scrapeTimeout
+	scrapeTimeout = 200 * time.Millisecond
+	defer func() { scrapeTimeout = timeout }()
+	s := newUDPTestTracker(t)
+	defer s.conn.Close()
+	s.mutex.Lock()
+	s.drop = 1000
+	s.mutex.Unlock()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:filesdee"))
+	}))
+	defer ts.Close()
+
+	torrent, err := ParseTorrentBytes(bencodeTestTorrent(map[string]interface{}{
+		"announce-list": [][]string{{s.url().String()}, {ts.URL + "/announce"}},
+		"info":          testInfoDict(),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	scrapes := torrent.Scrape()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the scrape to give up on the dead tracker, took %v", elapsed)
+	}
+	if len(scrapes) != 2 || scrapes[0].Error == "" || scrapes[1].Error != "" {
+		t.Errorf("Expected only the dead tracker to fail, got %+v", scrapes)
+	}
+}
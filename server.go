@@ -14,7 +14,7 @@ import (
 )
 
 type serverPeerChans struct {
-	conns chan *net.TCPConn
+	conns chan net.Conn
 }
 
 type Server struct {
@@ -27,7 +27,7 @@ type Server struct {
 func NewServer() *Server {
 	sv := new(Server)
 
-	sv.peerChans.conns = make(chan *net.TCPConn)
+	sv.peerChans.conns = make(chan net.Conn)
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	var err error
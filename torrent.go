@@ -5,22 +5,62 @@
 package main
 
 import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"errors"
 	"launchpad.net/tomb"
 	"log"
+	"math"
+	"strings"
+	"time"
 )
 
 type Torrent struct {
-	metaInfo MetaInfo
-	infoHash []byte
-	peer     chan PeerTuple
-	Stats    Stats
-	t        tomb.Tomb
+	metaInfo     MetaInfo
+	infoHash     []byte
+	infoBytes    []byte // the bencoded Info dictionary
+	infoHashV2   []byte // full SHA-256 info hash of a v2 torrent
+	v2           *V2Info
+	peer         chan PeerTuple
+	initialPeers []string // host:port of peers known before contacting any tracker
+	allTiers     bool     // announce to every tier of trackers at once
+	webSeeds     []string // BEP 19 web seed URLs
+	proxy        *Proxy   // trackers, peers and web seeds are reached through it
+	options      AnnounceOptions
+	urlOptions   map[string]AnnounceOptions // used instead of options for particular trackers
+	dhtAddr      string                     // address of our DHT node, empty to disable the DHT
+	dhtBootstrap []string                   // nodes used to join the DHT
+	dhtState     string                     // file that keeps the DHT routing table between runs
+	lsd          bool                       // look for peers on the local network
+	lsdInterface string                     // interface for LSD, empty for the system's choice
+	lsdInterval  time.Duration
+	Stats        Stats
+	t            tomb.Tomb
 }
 
+// PeerSource identifies where the address of a peer came from
+type PeerSource int
+
+const (
+	PeerSourceTracker PeerSource = iota // trackers listed in the metainfo
+	PeerSourceMagnet                    // x.pe peers in a magnet link
+	PeerSourceDHT
+	PeerSourcePEX
+	PeerSourceLSD
+	PeerSourceUser // peers added by hand
+)
+
+// leftUnknown is announced as the bytes left to download until the Info
+// dictionary of a magnet link arrives. Trackers may treat a torrent that
+// has nothing left as a seed.
+const leftUnknown = math.MaxInt32
+
 type Stats struct {
 	Left       int
 	Uploaded   int
 	Downloaded int
+	Corrupt    int // bytes discarded because they failed the hash check
+	Redundant  int // bytes of pieces that we already had
 }
 
 // Metainfo File Structure
@@ -32,11 +72,8 @@ type MetaInfo struct {
 		Name        string
 		Length      int
 		Md5sum      string
-		Files       []struct {
-			Length int
-			Md5sum string
-			Path   []string
-		}
+		Files       []FileDict
+		MetaVersion int "meta version"
 	}
 	Announce     string
 	AnnounceList [][]string "announce-list"
@@ -46,12 +83,29 @@ type MetaInfo struct {
 	Encoding     string
 }
 
+// FileDict describes one file in a multiple file torrent
+type FileDict struct {
+	Length int
+	Md5sum string
+	Path   []string
+	Attr   string // file attributes (BEP 47), 'p' marks a pad file
+}
+
+// isPad returns true if the file only pads the next file to a piece boundary.
+// Pad files are all zeros and are never written to disk.
+func (f FileDict) isPad() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
 // Init completes the initalization of the Torrent structure
 func (t *Torrent) Init() {
 	// Initialize bytes left to download
+	t.Stats.Left = 0
 	if len(t.metaInfo.Info.Files) > 0 {
 		for _, file := range t.metaInfo.Info.Files {
-			t.Stats.Left += file.Length
+			if !file.isPad() {
+				t.Stats.Left += file.Length
+			}
 		}
 	} else {
 		t.Stats.Left = t.metaInfo.Info.Length
@@ -59,6 +113,106 @@ func (t *Torrent) Init() {
 	// TODO: Read in the file and adjust bytes left
 }
 
+// hasInfo returns true if the Info dictionary is known. A Torrent created
+// from a magnet link has to download it from peers first.
+func (t *Torrent) hasInfo() bool {
+	return len(t.infoBytes) > 0
+}
+
+// isPrivate returns true if the private flag is set in the Info dictionary
+// (BEP 27)
+func (t *Torrent) isPrivate() bool {
+	return t.metaInfo.Info.Private == 1
+}
+
+// allowsPeerSource returns true if peers from the given source may be used.
+// A private torrent only gets peers from the trackers in its metainfo, or
+// from the user, and must never reveal its info hash anywhere else (BEP
+// 27 rules out the DHT, PEX and LSD). Every peer source has to check this
+// before it's started, since a magnet link only learns that a torrent is
+// private once the metadata arrives.
+func (t *Torrent) allowsPeerSource(source PeerSource) bool {
+	return !t.isPrivate() || source == PeerSourceTracker || source == PeerSourceUser
+}
+
+// infoHashes returns the info hashes that identify the torrent in the
+// swarm. A hybrid torrent is known by both its v1 and truncated v2 hash.
+func (t *Torrent) infoHashes() [][]byte {
+	hashes := [][]byte{t.infoHash}
+	if t.infoHashV2 != nil && !bytes.Equal(t.infoHash, t.infoHashV2[:20]) {
+		hashes = append(hashes, t.infoHashV2[:20])
+	}
+	return hashes
+}
+
+// pieceCount returns the number of pieces in the torrent. Pieces in a v2
+// torrent never span files, so they're counted per file.
+func (t *Torrent) pieceCount() int {
+	if t.v2 == nil {
+		return len(t.metaInfo.Info.Pieces) / 20
+	}
+	n := 0
+	for _, file := range t.v2.FileTree {
+		n += numPieces(file.Length, t.metaInfo.Info.PieceLength)
+	}
+	return n
+}
+
+// pieceHashes returns the SHA-1 hash of each piece. A v2 only torrent has
+// no SHA-1 hashes, its pieces are verified with merkle hashes by DiskIO.
+func (t *Torrent) pieceHashes() []string {
+	hashes := make([]string, t.pieceCount())
+	pieces := t.metaInfo.Info.Pieces
+	for i := range hashes {
+		if len(pieces) >= (i+1)*20 {
+			hashes[i] = pieces[i*20 : (i+1)*20]
+		}
+	}
+	return hashes
+}
+
+// setInfo populates and validates the Info dictionary from its bencoded form.
+// The file tree of a v2 or hybrid torrent is kept too. Piece layers aren't
+// part of the Info dictionary, so a v2 only torrent is refused unless every
+// file fits in one piece, and a hybrid one relies on its SHA-1 hashes.
+func (t *Torrent) setInfo(info []byte) error {
+	if err := bencode.Unmarshal(bytes.NewReader(info), &t.metaInfo.Info); err != nil {
+		return err
+	}
+	if err := t.metaInfo.Validate(); err != nil {
+		return err
+	}
+	if t.metaInfo.Info.MetaVersion == 2 {
+		v2, err := parseV2Info(info, info)
+		if err != nil {
+			return err
+		}
+		if t.metaInfo.Info.Pieces == "" {
+			if err = validateV2(&t.metaInfo, v2); err != nil {
+				return err
+			}
+			setV1Layout(&t.metaInfo, v2)
+		} else if err = validateHybrid(&t.metaInfo, v2); err != nil {
+			return err
+		}
+		t.v2 = v2
+	}
+	t.infoBytes = info
+	return nil
+}
+
+// AddPeer connects to a peer given by hand, as if a tracker had returned
+// it. It waits for the Torrent to be running, and fails once it has been
+// stopped.
+func (t *Torrent) AddPeer(peer PeerTuple) error {
+	select {
+	case t.peer <- peer:
+		return nil
+	case <-t.t.Dying():
+		return errors.New("torrent is stopped")
+	}
+}
+
 // Stop stops this Torrent session
 func (t *Torrent) Stop() error {
 	log.Println("Torrent : Stop : Stopping")
@@ -71,27 +225,180 @@ func (t *Torrent) Run() {
 	log.Println("Torrent : Run : Started")
 	defer t.t.Done()
 	defer log.Println("Torrent : Run : Completed")
-	t.Init()
 
-	diskIO := NewDiskIO(t.metaInfo)
-	go diskIO.Run()
+	controllerDiskIOChans := NewControllerDiskIOChans()
+	controllerRxChans := NewControllerRxChans(controllerDiskIOChans, NewControllerPeerManagerChans(), NewPeerControllerChans())
+	diskIO := NewDiskIO(t.metaInfo, t.v2, *controllerDiskIOChans)
+	metadataManager := NewMetadataManager(t.infoHash, t.infoBytes)
+
+	// Without the Info dictionary we can only talk to trackers and peers
+	// until one of them sends it to us
+	if t.hasInfo() {
+		if t.isPrivate() {
+			log.Println("Torrent : Run : Private torrent, only using peers from its trackers")
+		}
+		t.Init()
+		go diskIO.Run()
+	} else {
+		log.Printf("Torrent : Run : Fetching metadata for %x\n", t.infoHash)
+		t.Stats.Left = leftUnknown
+	}
+	go metadataManager.Run()
 
 	server := NewServer()
 	go server.Run()
 
 	trackerManager := NewTrackerManager(server.Port)
-	go trackerManager.Run(t.metaInfo, t.infoHash)
+	trackerManager.allTiers = t.allTiers
+	trackerManager.stats = t.Stats
+	trackerManager.proxy = t.proxy
+	trackerManager.options = t.options
+	trackerManager.urlOptions = t.urlOptions
+	go trackerManager.Run(t.metaInfo, t.infoHashes())
+
+	peerManager := NewPeerManager(t.infoHashes(), diskIO.peerChans, server.peerChans, trackerManager.peerChans, metadataManager.peerChans)
+	peerManager.proxy = t.proxy
+	peerManager.port = server.Port
+	peerManager.pex = t.allowsPeerSource(PeerSourcePEX)
 
-	peerManager := NewPeerManager(t.infoHash, diskIO.peerChans, server.peerChans, trackerManager.peerChans)
+	// The DHT carries UDP that a proxy may not relay, so it's only used
+	// when direct connections are allowed
+	var dht *DHT
+	if t.dhtAddr != "" && t.allowsPeerSource(PeerSourceDHT) && t.proxy.allowsDirect() {
+		var err error
+		if dht, err = NewDHT(t.dhtAddr, t.dhtBootstrap, t.dhtState); err != nil {
+			log.Println("Torrent : Run : Unable to start the DHT:", err)
+		} else {
+			dht.infoHashes = t.infoHashes()
+			dht.port = server.Port
+			dht.peerChans.peers = trackerManager.peerChans.peers
+			peerManager.dht = dht
+			peerManager.dhtPort = uint16(dht.Addr().Port)
+			go dht.Run()
+		}
+	}
+
+	// LSD is multicast on the local network, so a proxy can't carry it
+	var lsd *LSD
+	if t.lsd && t.allowsPeerSource(PeerSourceLSD) && t.proxy.allowsDirect() {
+		var err error
+		if lsd, err = NewLSD(t.lsdInterface, server.Port, t.infoHashes()); err != nil {
+			log.Println("Torrent : Run : Unable to start LSD:", err)
+		} else {
+			if t.lsdInterval != 0 {
+				lsd.Interval = t.lsdInterval
+			}
+			lsd.peerChans.peers = trackerManager.peerChans.peers
+			go lsd.Run()
+		}
+	}
 	go peerManager.Run()
 
+	if t.allowsPeerSource(PeerSourceMagnet) {
+		for _, addr := range t.initialPeers {
+			go func(addr string) {
+				peer, err := parsePeerAddress(addr, t.proxy)
+				if err != nil {
+					log.Println("Torrent : Run : Skipping magnet peer:", err)
+					return
+				}
+				trackerManager.peerChans.peers <- peer
+			}(addr)
+		}
+	}
+
+	// The Controller and web seeds start once DiskIO knows which pieces
+	// we already have
+	var controller *Controller
+	var webSeeds []*WebSeed
+	// Closed by DiskIO, so it's only read once
+	completed := diskIO.completed
+
 	for {
 		select {
+		case finishedPieces := <-diskIO.verified:
+			controller = NewController(finishedPieces, t.pieceHashes(), controllerRxChans)
+			go controller.Run()
+			for _, seedURL := range t.webSeeds {
+				webSeed := NewWebSeed(seedURL, t.metaInfo, t.v2, diskIO.peerChans, controllerRxChans)
+				webSeed.client = t.proxy.HTTPClient(webSeedTimeout)
+				webSeeds = append(webSeeds, webSeed)
+				go webSeed.Run()
+			}
+		case stats := <-diskIO.statsCh:
+			t.Stats = stats
+			select {
+			case trackerManager.peerChans.stats <- stats:
+			case <-t.t.Dying():
+			}
+		case <-completed:
+			completed = nil
+			log.Printf("Torrent : Run : Finished downloading %s\n", t.metaInfo.Info.Name)
+			select {
+			case trackerManager.peerChans.completed <- true:
+			case <-t.t.Dying():
+			}
+		case peer := <-t.peer:
+			log.Printf("Torrent : Run : Adding peer %s:%d\n", peer.IP, peer.Port)
+			go func(peer PeerTuple) { trackerManager.peerChans.peers <- peer }(peer)
+		case event := <-trackerManager.peerChans.events:
+			if event.Type == TrackerWarning {
+				log.Printf("Torrent : Run : Warning from tracker %s: %s\n", event.Announce, event.Message)
+			} else {
+				log.Printf("Torrent : Run : Tracker %s failed: %s\n", event.Announce, event.Message)
+			}
+		case info := <-metadataManager.info:
+			if err := t.setInfo(info); err != nil {
+				log.Println("Torrent : Run : Unable to decode metadata:", err)
+				t.t.Kill(err)
+				continue
+			}
+			log.Printf("Torrent : Run : Received metadata for %s\n", t.metaInfo.Info.Name)
+			if t.isPrivate() {
+				log.Println("Torrent : Run : Private torrent, only using peers from its trackers")
+				select {
+				case peerManager.private <- true:
+				case <-t.t.Dying():
+				}
+				select {
+				case trackerManager.peerChans.private <- true:
+				case <-t.t.Dying():
+				}
+				if dht != nil {
+					dht.Stop()
+					dht = nil
+				}
+				if lsd != nil {
+					lsd.Stop()
+					lsd = nil
+				}
+			}
+			t.Init()
+			diskIO.metaInfo = t.metaInfo
+			diskIO.v2 = t.v2
+			go diskIO.Run()
 		case <-t.t.Dying():
+			// Trackers are told that we've stopped and the DHT saves its
+			// state before any peers are disconnected
 			server.Stop()
-			peerManager.Stop()
 			trackerManager.Stop()
-			diskIO.Stop()
+			if dht != nil {
+				dht.Stop()
+			}
+			if lsd != nil {
+				lsd.Stop()
+			}
+			peerManager.Stop()
+			metadataManager.Stop()
+			for _, webSeed := range webSeeds {
+				webSeed.Stop()
+			}
+			if controller != nil {
+				controller.Stop()
+			}
+			if t.hasInfo() {
+				diskIO.Stop()
+			}
 			return
 		}
 	}
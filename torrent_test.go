@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newConnectRecorder starts a stand-in HTTP proxy that reports the address
+// of each CONNECT request and then hangs up
+func newConnectRecorder(t *testing.T) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "CONNECT" {
+				requests <- fields[1]
+			}
+			conn.Close()
+		}
+	}()
+	return ln, requests
+}
+
+// A peer given by hand should reach the PeerManager, which connects to it,
+// for public and private torrents alike
+func TestAddPeer(t *testing.T) {
+	peer, err := parsePeerAddress("127.0.0.1:6881", nil)
+	if err != nil || !peer.IP.Equal(net.IPv4(127, 0, 0, 1)) || peer.Port != 6881 {
+		t.Errorf("Unexpected peer %v (%v)", peer, err)
+	}
+	for _, bad := range []string{"127.0.0.1", ":6881", "127.0.0.1:0"} {
+		if _, err = parsePeerAddress(bad, nil); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+	proxyOnly, _ := ParseProxy("socks5://127.0.0.1:1080", true)
+	if _, err = parsePeerAddress("localhost:6881", proxyOnly); err == nil {
+		t.Errorf("Expected a host name not to be resolved locally in proxy-only mode")
+	}
+
+	// The connection attempt shows up at the proxy
+	ln, requests := newConnectRecorder(t)
+	defer ln.Close()
+	proxy, err := ParseProxy("http://"+ln.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, private := range []bool{false, true} {
+		torrent := m.Torrent()
+		torrent.proxy = proxy
+		if private {
+			torrent.metaInfo.Info.Private = 1
+		}
+		go torrent.Run()
+		if err = torrent.AddPeer(peer); err != nil {
+			t.Errorf("Expected the peer to be passed to the running torrent, got %v", err)
+		}
+		select {
+		case addr := <-requests:
+			if addr != "127.0.0.1:6881" {
+				t.Errorf("Expected a connection to the peer, got one to %s", addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected the peer to be connected to (private %v)", private)
+		}
+		torrent.Stop()
+		if err = torrent.AddPeer(peer); err == nil {
+			t.Errorf("Expected adding a peer to a stopped torrent to fail")
+		}
+	}
+}
+
+// Until the metadata of a magnet link arrives the size of the torrent isn't
+// known, but trackers shouldn't be told that nothing is left
+func TestMagnetAnnouncesUnknownLeft(t *testing.T) {
+	left := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		left <- r.URL.Query().Get("left")
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+
+	m, err := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&tr=" + url.QueryEscape(ts.URL+"/announce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := m.Torrent()
+	go running.Run()
+	select {
+	case s := <-left:
+		if s != strconv.Itoa(leftUnknown) {
+			t.Errorf("Expected left=%d before the metadata arrives, got %s", leftUnknown, s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected an announce to the tracker")
+	}
+	running.Stop()
+
+	// Init counts the bytes left once the metadata is known
+	torrent := m.Torrent()
+	torrent.Stats.Left = leftUnknown
+	if err = torrent.setInfo(bencodeTestTorrent(testInfoDict())); err != nil {
+		t.Fatal(err)
+	}
+	torrent.Init()
+	if torrent.Stats.Left != 20000 {
+		t.Errorf("Expected 20000 bytes left but got %d", torrent.Stats.Left)
+	}
+}
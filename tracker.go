@@ -5,9 +5,13 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/bencode-go"
+	"context"
 	"encoding/hex"
-	//"fmt"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"launchpad.net/tomb"
 	"log"
 	"math/rand"
@@ -15,6 +19,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,15 +32,141 @@ const (
 	Completed
 )
 
+const (
+	// Used when a tracker doesn't say how often to announce
+	defaultAnnounceInterval = 30 * time.Minute
+	// Give up on a single tracker request after this long
+	trackerTimeout = 30 * time.Second
+	// The stopped event gets less time, so that a tracker that's gone
+	// doesn't hold up shutting down
+	trackerStopTimeout = 5 * time.Second
+)
+
+// Wait between trackerRetryMin and trackerRetryMax before announcing again
+// after every tracker failed, doubling after each failure
+var (
+	trackerRetryMin = 15 * time.Second
+	trackerRetryMax = 30 * time.Minute
+)
+
+// Types of TrackerEvent
+const (
+	TrackerFailure = iota // The tracker answered with a failure reason
+	TrackerWarning        // The tracker answered with a warning message
+	TrackerError          // The tracker couldn't be reached or sent an invalid response
+)
+
+// TrackerEvent reports a problem with a tracker
+type TrackerEvent struct {
+	Announce string
+	Type     int
+	Message  string
+}
+
+// trackerFailure is the failure reason returned by a tracker
+type trackerFailure string
+
+func (f trackerFailure) Error() string {
+	return string(f)
+}
+
 type trackerPeerChans struct {
-	stats chan Stats
-	peers chan PeerTuple
+	stats     chan Stats // Transfer stats to send in announces
+	completed chan bool  // The download has completed
+	peers     chan PeerTuple
+	switched  chan string       // A private torrent must drop its peers when it switches trackers (BEP 27)
+	events    chan TrackerEvent // Other end is the Torrent
+	private   chan bool         // The metadata of a magnet link says the torrent is private
 }
 
 type trackerManager struct {
 	peerChans trackerPeerChans
 	port      uint16
-	t         tomb.Tomb
+	allTiers  bool  // announce to every tier at once instead of only the first tracker that answers
+	stats     Stats // the latest transfer stats, given to new trackers
+	proxy     *Proxy
+	options   AnnounceOptions
+	// Options for particular announce URLs, used instead of options
+	urlOptions map[string]AnnounceOptions
+	t          tomb.Tomb
+}
+
+// AnnounceOptions are the optional parameters sent in announces
+type AnnounceOptions struct {
+	NumWant       int    // number of peers to ask for, 0 for the tracker's default
+	IP            string // address to advertise instead of the one the announce comes from
+	IPv4          string // addresses to advertise for each protocol (BEP 7)
+	IPv6          string
+	NoPeerID      bool // peer lists may leave out peer IDs
+	NoCompact     bool // ask for peer lists as dictionaries rather than compact strings (BEP 23)
+	SupportCrypto bool // we accept encrypted connections
+}
+
+// validAddress returns an error unless value is an address of the given IP
+// version, optionally with a port
+func validAddress(value string, version int) error {
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || (version == 4) != (ip.To4() != nil) {
+		return fmt.Errorf("invalid IPv%d address %q", version, value)
+	}
+	return nil
+}
+
+// Set sets an option by the name of its announce parameter
+func (o *AnnounceOptions) Set(name, value string) (err error) {
+	switch name {
+	case "numwant":
+		if o.NumWant, err = strconv.Atoi(value); err == nil && o.NumWant < 0 {
+			err = errors.New("negative numwant")
+		}
+	case "ip":
+		o.IP = value
+	case "ipv4":
+		o.IPv4 = value
+		err = validAddress(value, 4)
+	case "ipv6":
+		o.IPv6 = value
+		err = validAddress(value, 6)
+	case "no_peer_id":
+		o.NoPeerID, err = strconv.ParseBool(value)
+	case "compact":
+		var compact bool
+		compact, err = strconv.ParseBool(value)
+		o.NoCompact = !compact
+	case "supportcrypto":
+		o.SupportCrypto, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown announce option %q", name)
+	}
+	if err != nil {
+		return fmt.Errorf("announce option %s: %s", name, err)
+	}
+	return nil
+}
+
+// parseTrackerOptions parses the announce options for one tracker, given as
+// its announce URL followed by # and comma separated name=value pairs.
+// Options that aren't given are the same as in base.
+func parseTrackerOptions(spec string, base AnnounceOptions) (string, AnnounceOptions, error) {
+	i := strings.LastIndex(spec, "#")
+	if i < 0 {
+		return "", base, fmt.Errorf("%q has no options after the announce URL", spec)
+	}
+	options := base
+	for _, pair := range strings.Split(spec[i+1:], ",") {
+		nameValue := strings.SplitN(pair, "=", 2)
+		if len(nameValue) != 2 {
+			return "", base, fmt.Errorf("announce option %q is not name=value", pair)
+		}
+		if err := options.Set(strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1])); err != nil {
+			return "", base, err
+		}
+	}
+	return spec[:i], options, nil
 }
 
 type TrackerResponse struct {
@@ -45,17 +177,28 @@ type TrackerResponse struct {
 	TrackerId      string "tracker id"
 	Complete       int
 	Incomplete     int
-	Peers          string "peers"
-	//TODO: Figure out how to handle dict of peers
-	//	Peers          []Peers "peers"
+	// The peers are decoded separately by parseTrackerPeers, since they
+	// can be a string or a list
 }
 
 type tracker struct {
-	announceURL *url.URL
+	tiers       [][]*url.URL // BEP 12 tiers, each shuffled once
+	current     *url.URL     // the tracker that last answered
+	private     bool
+	mutex       sync.Mutex                   // guards udpClients, which Stop closes
+	udpClients  map[string]*udpTrackerClient // BEP 15 trackers by host:port
+	client      *http.Client
+	proxy       *Proxy
+	trackerIDs  map[string]string // tracker id from each announce URL, sent back on later announces
+	options     AnnounceOptions
+	urlOptions  map[string]AnnounceOptions // used instead of options for particular announce URLs
+	failures    int                        // announces in a row where no tracker answered
 	response    TrackerResponse
+	peers       []PeerTuple // peers from the last response
 	peerChans   trackerPeerChans
 	completedCh chan bool
-	timer       <-chan time.Time
+	privateCh   chan bool
+	statsMutex  sync.Mutex // stats are updated while an announce is running
 	stats       Stats
 	key         string
 	port        uint16
@@ -72,25 +215,221 @@ func initKey() string {
 	return hex.EncodeToString(key)
 }
 
-func (tr *tracker) Announce(event int) {
+// announceTiers returns the tiers of trackers in the metainfo. The
+// announce key is only used if there is no announce-list (BEP 12).
+func announceTiers(m MetaInfo) (tiers [][]string) {
+	for _, tier := range m.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	if len(tiers) == 0 && m.Announce != "" {
+		tiers = [][]string{{m.Announce}}
+	}
+	return
+}
+
+// Announce sends an event to the trackers following BEP 12. The trackers in
+// each tier are tried in order, falling through to the next tier if none
+// of them answer. A tracker that answers moves to the front of its tier.
+// The stopped event is only sent to the tracker that last answered.
+// Announce returns how long to wait before announcing again, or 0 if it
+// shouldn't be rescheduled, and whether a tracker answered.
+//
+// Announces are only made by Run, and by Stop once Run has returned, so
+// they never overlap.
+func (tr *tracker) Announce(event int) (time.Duration, bool) {
 	log.Println("Tracker : Announce : Started")
 	defer log.Println("Tracker : Announce : Completed")
 
 	if tr.infoHash == nil {
 		log.Println("Tracker : Announce : Error: infoHash undefined")
-		return
+		return 0, false
+	}
+
+	if event == Stopped {
+		if tr.current == nil {
+			return 0, false
+		}
+		if err := tr.announce(tr.current, event); err != nil {
+			tr.reportError(tr.current, err)
+			return 0, false
+		}
+		return 0, true
+	}
+
+	for _, tier := range tr.tiers {
+		for i, announceURL := range tier {
+			if err := tr.announce(announceURL, event); err != nil {
+				tr.reportError(announceURL, err)
+				continue
+			}
+			if tr.response.WarningMessage != "" {
+				tr.report(announceURL, TrackerWarning, tr.response.WarningMessage)
+			}
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = announceURL
+
+			if tr.private && tr.current != nil && tr.current != announceURL {
+				// Peers from the old tracker may not be used any more, so
+				// they're dropped before the new tracker's peers arrive
+				select {
+				case tr.peerChans.switched <- announceURL.String():
+				case <-tr.t.Dying():
+				}
+			}
+			tr.current = announceURL
+			tr.failures = 0
+			nextAnnounce := tr.announceInterval()
+			log.Printf("Tracker : Announce : Scheduling next announce in %v\n", nextAnnounce)
+			tr.handleResponse()
+			return nextAnnounce, true
+		}
+	}
+
+	tr.failures++
+	delay := retryDelay(tr.failures)
+	log.Printf("Tracker : Announce : None of the trackers answered, trying again in %v\n", delay)
+	return delay, false
+}
+
+// announceOptions returns the options for announces to a tracker
+func (tr *tracker) announceOptions(u *url.URL) AnnounceOptions {
+	if options, ok := tr.urlOptions[u.String()]; ok {
+		return options
+	}
+	return tr.options
+}
+
+// setStats updates the transfer stats sent in the next announce
+func (tr *tracker) setStats(stats Stats) {
+	tr.statsMutex.Lock()
+	tr.stats = stats
+	tr.statsMutex.Unlock()
+}
+
+// currentStats returns the transfer stats to send in an announce
+func (tr *tracker) currentStats() Stats {
+	tr.statsMutex.Lock()
+	defer tr.statsMutex.Unlock()
+	return tr.stats
+}
+
+// retryDelay returns how long to wait before announcing again after the
+// given number of failures in a row. The delay grows exponentially, with
+// jitter so that clients don't all hit a tracker at once after an outage.
+func retryDelay(failures int) time.Duration {
+	delay := trackerRetryMax
+	if failures < 20 {
+		if d := trackerRetryMin << uint(failures-1); d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// report passes a problem with a tracker on to the Torrent. The event is
+// dropped if the Torrent is too far behind.
+func (tr *tracker) report(announceURL *url.URL, eventType int, message string) {
+	select {
+	case tr.peerChans.events <- TrackerEvent{announceURL.String(), eventType, message}:
+	default:
+	}
+}
+
+// reportError reports an error from announce, distinguishing between a
+// tracker that answered with a failure reason and one that didn't answer
+func (tr *tracker) reportError(announceURL *url.URL, err error) {
+	if _, ok := err.(trackerFailure); ok {
+		tr.report(announceURL, TrackerFailure, err.Error())
+	} else {
+		tr.report(announceURL, TrackerError, err.Error())
 	}
+}
 
-	// Build and encode the Tracker Request
-	urlParams := url.Values{}
+// announceInterval returns how long to wait before the next regular
+// announce, honoring the min interval if the tracker sent one
+func (tr *tracker) announceInterval() time.Duration {
+	interval := tr.response.Interval
+	if interval <= 0 {
+		return defaultAnnounceInterval
+	}
+	if tr.response.MinInterval > interval {
+		interval = tr.response.MinInterval
+	}
+	return time.Second * time.Duration(interval)
+}
+
+// announceContext limits a single request to a tracker. Requests are
+// abandoned when the tracker is stopped, apart from the stopped event,
+// which has a shorter timeout instead.
+func (tr *tracker) announceContext(event int) (context.Context, context.CancelFunc) {
+	if event == Stopped {
+		return context.WithTimeout(context.Background(), trackerStopTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), trackerTimeout)
+	go func() {
+		select {
+		case <-tr.t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// announce sends a single request to a tracker and stores its response
+func (tr *tracker) announce(u *url.URL, event int) error {
+	ctx, cancel := tr.announceContext(event)
+	defer cancel()
+	switch u.Scheme {
+	case "udp":
+		return tr.announceUDP(ctx, u, event)
+	case "http", "https":
+	default:
+		return fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+
+	// Build and encode the Tracker Request. Parameters that are already in
+	// the announce URL, like a private tracker's passkey, are kept.
+	urlParams := u.Query()
 	urlParams.Set("info_hash", string(tr.infoHash))
 	urlParams.Set("peer_id", string(PeerID[:]))
 	urlParams.Set("key", tr.key)
 	urlParams.Set("port", strconv.FormatUint(uint64(tr.port), 10))
-	urlParams.Set("uploaded", strconv.Itoa(tr.stats.Uploaded))
-	urlParams.Set("downloaded", strconv.Itoa(tr.stats.Downloaded))
-	urlParams.Set("left", strconv.Itoa(tr.stats.Left))
-	urlParams.Set("compact", "1")
+	stats := tr.currentStats()
+	urlParams.Set("uploaded", strconv.Itoa(stats.Uploaded))
+	urlParams.Set("downloaded", strconv.Itoa(stats.Downloaded))
+	urlParams.Set("left", strconv.Itoa(stats.Left))
+	urlParams.Set("corrupt", strconv.Itoa(stats.Corrupt))
+	urlParams.Set("redundant", strconv.Itoa(stats.Redundant))
+	options := tr.announceOptions(u)
+	if options.NoCompact {
+		urlParams.Set("compact", "0")
+	} else {
+		urlParams.Set("compact", "1")
+	}
+	if options.NoPeerID {
+		urlParams.Set("no_peer_id", "1")
+	}
+	if options.NumWant > 0 {
+		urlParams.Set("numwant", strconv.Itoa(options.NumWant))
+	}
+	if options.IP != "" {
+		urlParams.Set("ip", options.IP)
+	}
+	if options.IPv4 != "" {
+		urlParams.Set("ipv4", options.IPv4)
+	}
+	if options.IPv6 != "" {
+		urlParams.Set("ipv6", options.IPv6)
+	}
+	if options.SupportCrypto {
+		urlParams.Set("supportcrypto", "1")
+	}
+	if trackerID, ok := tr.trackerIDs[u.String()]; ok {
+		urlParams.Set("trackerid", trackerID)
+	}
 	switch event {
 	case Started:
 		urlParams.Set("event", "started")
@@ -99,83 +438,219 @@ func (tr *tracker) Announce(event int) {
 	case Completed:
 		urlParams.Set("event", "completed")
 	}
-	announceURL := *tr.announceURL
+	announceURL := *u
 	announceURL.RawQuery = urlParams.Encode()
 
 	// Send a request to the Tracker
 	log.Printf("Announce: %s\n", announceURL.String())
-	resp, err := http.Get(announceURL.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", announceURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := tr.client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
 
 	// Unmarshall the Tracker Response
-	err = bencode.Unmarshal(resp.Body, &tr.response)
+	tr.response = TrackerResponse{}
+	err = bencode.Unmarshal(bytes.NewReader(body), &tr.response)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
+	}
+	if tr.response.FailureReason != "" {
+		return trackerFailure(tr.response.FailureReason)
+	}
+	if tr.response.TrackerId != "" {
+		tr.trackerIDs[u.String()] = tr.response.TrackerId
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	dict, _ := decoded.(map[string]interface{})
+	tr.peers, err = parseTrackerPeers(dict, tr.proxy)
+	return err
+}
+
+// parseCompactPeers parses peers in compact form, where each peer is an IP
+// address of ipLen bytes followed by a 2 byte port. If there's a partial
+// entry at the end, the whole entries are returned along with an error.
+func parseCompactPeers(peers string, ipLen int) (tuples []PeerTuple, err error) {
+	entryLen := ipLen + 2
+	if len(peers)%entryLen != 0 {
+		err = fmt.Errorf("compact peers length %d is not a multiple of %d", len(peers), entryLen)
+	}
+	tuples = make([]PeerTuple, 0, len(peers)/entryLen)
+	for i := 0; i+entryLen <= len(peers); i += entryLen {
+		ip := make(net.IP, ipLen)
+		copy(ip, peers[i:i+ipLen])
+		port := uint16(peers[i+ipLen])<<8 | uint16(peers[i+ipLen+1])
+		tuples = append(tuples, PeerTuple{ip, port})
 	}
+	return tuples, err
+}
 
-	// Schedule a timer to poll this announce URL every interval
-	if tr.response.Interval != 0 && event != Stopped {
-		nextAnnounce := time.Second * time.Duration(tr.response.Interval)
-		log.Printf("Tracker : Announce : Scheduling next announce in %v\n", nextAnnounce)
-		tr.timer = time.After(nextAnnounce)
+// parsePeerDicts parses peers in the original non-compact form, a list of
+// dictionaries with ip, port and peer id keys. The ip may be a hostname.
+// The peer id is ignored, since the handshake tells us the same thing.
+// Invalid entries, and hostnames that can't be resolved through the proxy,
+// are skipped.
+func parsePeerDicts(peers []interface{}, proxy *Proxy) []PeerTuple {
+	var tuples []PeerTuple
+	for _, peer := range peers {
+		dict, ok := peer.(map[string]interface{})
+		if !ok {
+			log.Printf("Tracker : parsePeerDicts : Skipping peer that is not a dictionary: %v\n", peer)
+			continue
+		}
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		if host == "" || port <= 0 || port > 65535 {
+			log.Printf("Tracker : parsePeerDicts : Skipping invalid peer address %q port %d\n", host, port)
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := proxy.lookupIP(host)
+			if err != nil || len(ips) == 0 {
+				log.Printf("Tracker : parsePeerDicts : Unable to resolve peer %s: %v\n", host, err)
+				continue
+			}
+			ip = ips[0]
+		}
+		tuples = append(tuples, PeerTuple{ip, uint16(port)})
 	}
+	return tuples
+}
 
-	// If we're not stopping, send the list of peers to the peers channel
-	if event != Stopped {
-		// Parse peers in binary mode and return peer IP + port
-		for i := 0; i < len(tr.response.Peers); i += 6 {
-			peerIP := net.IPv4(tr.response.Peers[i], tr.response.Peers[i+1], tr.response.Peers[i+2], tr.response.Peers[i+3])
-			peerPort := uint16(tr.response.Peers[i+4]) << 8
-			peerPort = peerPort | uint16(tr.response.Peers[i+5])
-			// Send the peer IP+port to the Torrent Manager
-			go func() { tr.peerChans.peers <- PeerTuple{peerIP, peerPort} }()
+// parseTrackerPeers returns the peers in a decoded tracker response. The
+// peers key is either a compact string of IPv4 peers or a list of
+// dictionaries, and the peers6 key holds compact IPv6 peers (BEP 7).
+// Malformed peers are skipped rather than losing the rest of them.
+func parseTrackerPeers(response map[string]interface{}, proxy *Proxy) (peers []PeerTuple, err error) {
+	switch p := response["peers"].(type) {
+	case nil:
+	case string:
+		if peers, err = parseCompactPeers(p, net.IPv4len); err != nil {
+			log.Println("Tracker : parseTrackerPeers : Ignoring partial peer:", err)
+		}
+	case []interface{}:
+		peers = parsePeerDicts(p, proxy)
+	default:
+		return nil, errors.New("peers is neither a string nor a list")
+	}
+	if p, ok := response["peers6"].(string); ok {
+		peers6, err := parseCompactPeers(p, net.IPv6len)
+		if err != nil {
+			log.Println("Tracker : parseTrackerPeers : Ignoring partial IPv6 peer:", err)
 		}
+		peers = append(peers, peers6...)
+	}
+	return peers, nil
+}
+
+// handleResponse passes on the peers from the last tracker response
+func (tr *tracker) handleResponse() {
+	for _, peer := range tr.peers {
+		// Send the peer IP+port to the Torrent Manager
+		go func(peer PeerTuple) { tr.peerChans.peers <- peer }(peer)
 	}
 }
 
+// Stop abandons any announce in progress, then sends the stopped event
 func (tr *tracker) Stop() error {
 	log.Println("Tracker : Stop : Stopping")
-	tr.Announce(Stopped)
 	tr.t.Kill(nil)
-	return tr.t.Wait()
+	err := tr.t.Wait()
+	tr.Announce(Stopped)
+	tr.mutex.Lock()
+	for _, client := range tr.udpClients {
+		client.Close()
+	}
+	tr.mutex.Unlock()
+	return err
 }
 
 func (tr *tracker) Run() {
-	log.Printf("Tracker : Run : Started (%s)\n", tr.announceURL)
+	log.Printf("Tracker : Run : Started (%v)\n", tr.tiers)
 	defer tr.t.Done()
-	defer log.Printf("Tracker : Run : Completed (%s)\n", tr.announceURL)
+	defer log.Printf("Tracker : Run : Completed (%v)\n", tr.tiers)
 
-	tr.timer = make(<-chan time.Time)
-	tr.Announce(Started)
+	// Announces are only made from here, apart from the stopped event, so
+	// the timer belongs to Run alone
+	event := Started
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-tr.t.Dying():
 			return
+		case <-tr.privateCh:
+			tr.private = true
+			continue
 		case <-tr.completedCh:
-			go tr.Announce(Completed)
-		case <-tr.timer:
-			log.Printf("Tracker : Run : Interval Timer Expired (%s)\n", tr.announceURL)
-			go tr.Announce(Interval)
-		case stats := <-tr.peerChans.stats:
-			log.Println("read from stats", stats)
+			event = Completed
+			if !timer.Stop() {
+				// Don't announce a second time for a timer that already
+				// went off
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+			if event == Interval {
+				log.Printf("Tracker : Run : Interval Timer Expired (%v)\n", tr.current)
+			}
+		}
+		delay, answered := tr.Announce(event)
+		if delay > 0 {
+			timer.Reset(delay)
+		}
+		if answered {
+			// Until then the event is sent again with each retry
+			event = Interval
 		}
 	}
 }
 
-func newTracker(key string, chans trackerPeerChans, port uint16, infoHash []byte, announce string) *tracker {
-	announceURL, err := url.Parse(announce)
-	if err != nil {
-		log.Fatal(err)
-	}
+// newTracker returns a tracker that announces to the given tiers. The order
+// of the trackers within each tier is randomized.
+func newTracker(key string, chans trackerPeerChans, port uint16, infoHash []byte, tiers [][]string, private bool) *tracker {
 	if len(key) < 8 {
 		log.Fatalf("newTracker: key too short %d (expected at least 8 bytes)\n", len(key))
 	}
-	tracker := &tracker{key: key, peerChans: chans, port: port, infoHash: infoHash, announceURL: announceURL}
+	tracker := &tracker{key: key, peerChans: chans, port: port, infoHash: infoHash, private: private}
+	tracker.client = &http.Client{Timeout: trackerTimeout}
+	tracker.trackerIDs = make(map[string]string)
+	tracker.completedCh = make(chan bool, 1)
+	tracker.privateCh = make(chan bool, 1)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, announces := range tiers {
+		var tier []*url.URL
+		for _, i := range r.Perm(len(announces)) {
+			announceURL, err := url.Parse(announces[i])
+			if err != nil {
+				log.Printf("newTracker : Ignoring invalid announce URL %q: %s\n", announces[i], err)
+				continue
+			}
+			tier = append(tier, announceURL)
+		}
+		if len(tier) > 0 {
+			tracker.tiers = append(tracker.tiers, tier)
+		}
+	}
 	tracker.infoHash = make([]byte, len(infoHash))
 	copy(tracker.infoHash, infoHash)
 	return tracker
@@ -185,6 +660,10 @@ func NewTrackerManager(port uint16) *trackerManager {
 	chans := new(trackerPeerChans)
 	chans.peers = make(chan PeerTuple)
 	chans.stats = make(chan Stats)
+	chans.completed = make(chan bool)
+	chans.switched = make(chan string)
+	chans.events = make(chan TrackerEvent, 16)
+	chans.private = make(chan bool)
 	return &trackerManager{peerChans: *chans, port: port}
 }
 
@@ -194,30 +673,95 @@ func (tm *trackerManager) Stop() error {
 	return tm.t.Wait()
 }
 
-// Run spawns trackers for each announce URL
-func (tm *trackerManager) Run(m MetaInfo, infoHash []byte) {
+// Run spawns trackers for each announce URL and info hash
+func (tm *trackerManager) Run(m MetaInfo, infoHashes [][]byte) {
 	log.Println("TrackerManager : Run : Started")
 	defer tm.t.Done()
 	defer log.Println("TrackerManager : Run : Completed")
 
-	// TODO: Handle multiple announce URL's
-	/*
-		for announceURL := m.AnnounceList {
-			tr := new(Tracker)
-			tr.metaInfo = m
-			tr.announceURL = announceURL
-			tr.Run()
+	// A private torrent uses one tracker at a time and only switches on
+	// failure (BEP 27)
+	private := m.Info.Private == 1
+	tiers := announceTiers(m)
+	var groups [][][]string
+	switch {
+	case len(tiers) == 0:
+		log.Println("TrackerManager : Run : No trackers to announce to")
+	case tm.allTiers && !private:
+		for _, tier := range tiers {
+			groups = append(groups, [][]string{tier})
 		}
-	*/
-
-	tr := newTracker(initKey(), tm.peerChans, tm.port, infoHash, m.Announce)
-	go tr.Run()
+	default:
+		groups = [][][]string{tiers}
+	}
+	trackers := tm.startTrackers(groups, infoHashes, private)
 
 	for {
 		select {
+		case stats := <-tm.peerChans.stats:
+			tm.stats = stats
+			for _, tr := range trackers {
+				tr.setStats(stats)
+			}
+		case <-tm.peerChans.completed:
+			log.Println("TrackerManager : Run : Download completed")
+			for _, tr := range trackers {
+				select {
+				case tr.completedCh <- true:
+				default:
+					// The tracker is already going to announce it
+				}
+			}
+		case <-tm.peerChans.private:
+			if private {
+				continue
+			}
+			private = true
+			if len(groups) > 1 {
+				log.Println("TrackerManager : Run : Private torrent, announcing to one tracker at a time")
+				stopTrackers(trackers)
+				groups = [][][]string{tiers}
+				trackers = tm.startTrackers(groups, infoHashes, private)
+				continue
+			}
+			for _, tr := range trackers {
+				tr.privateCh <- true
+			}
 		case <-tm.t.Dying():
-			tr.Stop()
+			stopTrackers(trackers)
 			return
 		}
 	}
 }
+
+// startTrackers starts a tracker for each group of tiers. A hybrid torrent
+// is announced under both of its info hashes.
+func (tm *trackerManager) startTrackers(groups [][][]string, infoHashes [][]byte, private bool) (trackers []*tracker) {
+	for _, group := range groups {
+		for _, infoHash := range infoHashes {
+			tr := newTracker(initKey(), tm.peerChans, tm.port, infoHash, group, private)
+			tr.stats = tm.stats
+			tr.proxy = tm.proxy
+			tr.client = tm.proxy.HTTPClient(trackerTimeout)
+			tr.options = tm.options
+			tr.urlOptions = tm.urlOptions
+			go tr.Run()
+			trackers = append(trackers, tr)
+		}
+	}
+	return
+}
+
+// stopTrackers stops the trackers at the same time, so that one which
+// doesn't answer the stopped event doesn't hold up the others
+func stopTrackers(trackers []*tracker) {
+	var wg sync.WaitGroup
+	for _, tr := range trackers {
+		wg.Add(1)
+		go func(tr *tracker) {
+			defer wg.Done()
+			tr.Stop()
+		}(tr)
+	}
+	wg.Wait()
+}
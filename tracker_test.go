@@ -0,0 +1,470 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTracker starts an HTTP tracker that answers every announce with
+// the given bencoded response
+func newTestTracker(response string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+}
+
+// receivePeer waits for a peer from the tracker
+func receivePeer(t *testing.T, chans trackerPeerChans) PeerTuple {
+	select {
+	case peer := <-chans.peers:
+		return peer
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a peer from the tracker")
+	}
+	return PeerTuple{}
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	var m MetaInfo
+	m.Announce = "http://primary/announce"
+	if tiers := announceTiers(m); len(tiers) != 1 || tiers[0][0] != m.Announce {
+		t.Errorf("Expected the announce URL as the only tier, got %v", tiers)
+	}
+	m.AnnounceList = [][]string{{"http://a/announce", "http://b/announce"}, {}, {"http://c/announce"}}
+	if tiers := announceTiers(m); len(tiers) != 2 || len(tiers[0]) != 2 || tiers[1][0] != "http://c/announce" {
+		t.Errorf("Expected the announce-list to replace the announce URL, got %v", tiers)
+	}
+}
+
+func TestTrackerFallsThroughTiers(t *testing.T) {
+	failing := newTestTracker("d14:failure reason4:deade")
+	defer failing.Close()
+	dead := newTestTracker("")
+	dead.Close()
+	alive := newTestTracker("d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	defer alive.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{
+		{failing.URL, dead.URL},
+		{alive.URL, failing.URL},
+	}, false)
+	// Make sure the live tracker isn't tried first
+	tr.tiers[1][0], tr.tiers[1][1] = tr.tiers[1][1], tr.tiers[1][0]
+
+	tr.Announce(Started)
+	peer := receivePeer(t, chans)
+	if peer.Port != 6881 || !peer.IP.Equal([]byte{10, 0, 0, 1}) {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+	if tr.current == nil || tr.current.String() != alive.URL {
+		t.Errorf("Expected %s to be the current tracker, got %v", alive.URL, tr.current)
+	}
+	if tr.tiers[1][0].String() != alive.URL {
+		t.Errorf("Expected the tracker that answered to move to the front of its tier, got %v", tr.tiers[1])
+	}
+}
+
+func TestPrivateTrackerSwitchDisconnectsPeers(t *testing.T) {
+	first := newTestTracker("d8:intervali1800e5:peers0:e")
+	second := newTestTracker("d8:intervali1800e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	defer second.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{first.URL}, {second.URL}}, true)
+	tr.Announce(Started)
+	first.Close()
+	go tr.Announce(Interval)
+
+	// The old peers have to be dropped before the new ones arrive
+	select {
+	case announce := <-chans.switched:
+		if announce != second.URL {
+			t.Errorf("Expected a switch to %s but got %s", second.URL, announce)
+		}
+	case peer := <-chans.peers:
+		t.Errorf("Expected the switch before the new tracker's peer %v", peer)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected a private torrent to drop its peers when switching trackers")
+	}
+	receivePeer(t, chans)
+}
+
+// Peers that never connected should be forgotten when switching trackers,
+// so that they can be connected to again
+func TestPeerManagerSwitchForgetsPeers(t *testing.T) {
+	chans := NewTrackerManager(6881).peerChans
+	pm := NewPeerManager([][]byte{make([]byte, 20)}, diskIOPeerChans{}, serverPeerChans{conns: make(chan net.Conn)}, chans, metadataPeerChans{})
+	go pm.Run()
+	chans.peers <- PeerTuple{net.IPv4(127, 0, 0, 1), 1}
+	chans.switched <- "http://tracker/announce"
+	pm.Stop()
+	if len(pm.peers) != 0 {
+		t.Errorf("Expected the unconnected peer to be forgotten, got %v", pm.peers)
+	}
+}
+
+func TestParseTrackerPeers(t *testing.T) {
+	peers, err := parseTrackerPeers(map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{"ip": "10.0.0.2", "port": int64(6882), "peer id": "-XX0001-aaaaaaaaaaaa"},
+			map[string]interface{}{"ip": "localhost", "port": int64(6883)},
+		},
+		"peers6": "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 3 {
+		t.Fatalf("Expected 3 peers but got %v", peers)
+	}
+	if !peers[0].IP.Equal([]byte{10, 0, 0, 2}) || peers[0].Port != 6882 {
+		t.Errorf("Unexpected dictionary peer %v", peers[0])
+	}
+	if !peers[1].IP.IsLoopback() || peers[1].Port != 6883 {
+		t.Errorf("Expected the hostname peer to be resolved, got %v", peers[1])
+	}
+	if peers[2].IP.String() != "2001:db8::1" || peers[2].Port != 6881 {
+		t.Errorf("Unexpected IPv6 peer %v", peers[2])
+	}
+
+	// Malformed peers are skipped, keeping the rest
+	peers, err = parseTrackerPeers(map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{"ip": "10.0.0.2"},
+			"10.0.0.2",
+			map[string]interface{}{"ip": "nonexistent.invalid", "port": int64(6882)},
+			map[string]interface{}{"ip": "10.0.0.3", "port": int64(6883)},
+		},
+		"peers6": "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1\x20\x01",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || !peers[0].IP.Equal([]byte{10, 0, 0, 3}) || peers[1].IP.String() != "2001:db8::1" {
+		t.Errorf("Expected only the valid peers, got %v", peers)
+	}
+	if peers, err = parseTrackerPeers(map[string]interface{}{"peers": "\x0a\x00\x00\x01\x1a\xe1\x0a"}, nil); err != nil || len(peers) != 1 {
+		t.Errorf("Expected the whole compact peer, got %v (%v)", peers, err)
+	}
+	if _, err = parseTrackerPeers(map[string]interface{}{"peers": int64(1)}, nil); err == nil {
+		t.Errorf("Expected an error for peers that are neither a string nor a list")
+	}
+
+	// Hostnames aren't looked up locally in proxy-only mode
+	proxy, _ := ParseProxy("socks5://127.0.0.1:1080", true)
+	peers, err = parseTrackerPeers(map[string]interface{}{
+		"peers": []interface{}{
+			map[string]interface{}{"ip": "localhost", "port": int64(6883)},
+			map[string]interface{}{"ip": "10.0.0.3", "port": int64(6883)},
+		},
+	}, proxy)
+	if err != nil || len(peers) != 1 || !peers[0].IP.Equal([]byte{10, 0, 0, 3}) {
+		t.Errorf("Expected only the peer given by address, got %v (%v)", peers, err)
+	}
+}
+
+func TestTrackerNonCompactResponse(t *testing.T) {
+	ts := newTestTracker("d8:intervali1800e5:peersld2:ip8:10.0.0.37:peer id20:-XX0001-aaaaaaaaaaaa4:porti6884eeee")
+	defer ts.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL}}, false)
+	tr.Announce(Started)
+	if peer := receivePeer(t, chans); !peer.IP.Equal([]byte{10, 0, 0, 3}) || peer.Port != 6884 {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, trackerRetryMin},
+		{3, 4 * trackerRetryMin},
+		{100, trackerRetryMax},
+	} {
+		for i := 0; i < 10; i++ {
+			if d := retryDelay(test.failures); d < test.max/2 || d > test.max {
+				t.Errorf("Delay %v after %d failures is outside [%v, %v]", d, test.failures, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestTrackerWarningsAndTrackerID(t *testing.T) {
+	queries := make(chan url.Values, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali60e12:min intervali120e10:tracker id3:abc15:warning message4:slowe"))
+	}))
+	defer ts.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL}}, false)
+	tr.Announce(Started)
+	tr.Announce(Interval)
+	if q := <-queries; q.Get("trackerid") != "" {
+		t.Errorf("Didn't expect a tracker id in the first announce")
+	}
+	if q := <-queries; q.Get("trackerid") != "abc" {
+		t.Errorf("Expected the tracker id to be sent back, got %q", q.Get("trackerid"))
+	}
+	if d := tr.announceInterval(); d != 120*time.Second {
+		t.Errorf("Expected the min interval to be honored, got %v", d)
+	}
+	if event := <-chans.events; event.Type != TrackerWarning || event.Message != "slow" || event.Announce != ts.URL {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestTrackerFailuresAreReported(t *testing.T) {
+	failing := newTestTracker("d14:failure reason6:bannede")
+	defer failing.Close()
+	dead := newTestTracker("")
+	dead.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{failing.URL}, {dead.URL}}, false)
+	delay, answered := tr.Announce(Started)
+	if event := <-chans.events; event.Type != TrackerFailure || event.Message != "banned" {
+		t.Errorf("Expected the failure reason to be reported, got %+v", event)
+	}
+	if event := <-chans.events; event.Type != TrackerError || event.Announce != dead.URL {
+		t.Errorf("Expected an error for the unreachable tracker, got %+v", event)
+	}
+	if answered || tr.failures != 1 || delay < trackerRetryMin/2 || delay > trackerRetryMin {
+		t.Errorf("Expected another announce to be scheduled after %d failures, got %v", tr.failures, delay)
+	}
+}
+
+// A tracker that keeps failing should be retried again and again, not just
+// once
+func TestTrackerRunRetries(t *testing.T) {
+	retryMin := trackerRetryMin
+	trackerRetryMin = 10 * time.Millisecond
+	defer func() { trackerRetryMin = retryMin }()
+	announces := make(chan bool, 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announces <- true
+		w.Write([]byte("d14:failure reason4:deade"))
+	}))
+	defer ts.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL}}, false)
+	go tr.Run()
+	defer tr.Stop()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-announces:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected announce %d to be retried", i+1)
+		}
+	}
+}
+
+// The completed event should be retried until a tracker has it, rather than
+// turning into a regular announce
+func TestTrackerRetriesCompleted(t *testing.T) {
+	retryMin := trackerRetryMin
+	trackerRetryMin = 10 * time.Millisecond
+	defer func() { trackerRetryMin = retryMin }()
+	type announce struct {
+		event  string
+		failed bool
+	}
+	announces := make(chan announce, 100)
+	fail := make(chan bool, 1)
+	fail <- true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failing := <-fail
+		fail <- failing
+		announces <- announce{r.URL.Query().Get("event"), failing}
+		if failing {
+			w.Write([]byte("d14:failure reason4:deade"))
+		} else {
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		}
+	}))
+	defer ts.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL}}, false)
+	go tr.Run()
+	defer tr.Stop()
+	next := func() announce {
+		select {
+		case a := <-announces:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an announce")
+		}
+		return announce{}
+	}
+
+	if a := next(); a.event != "started" {
+		t.Fatalf("Expected the started event first, got %q", a.event)
+	}
+	tr.completedCh <- true
+	for next().event != "completed" {
+	}
+	if a := next(); a.event != "completed" {
+		t.Errorf("Expected the completed event to be retried, got %q", a.event)
+	}
+	<-fail
+	fail <- false
+	for {
+		a := next()
+		if a.event != "completed" {
+			t.Fatalf("Expected the completed event until a tracker answered, got %q", a.event)
+		}
+		if !a.failed {
+			break
+		}
+	}
+}
+
+// The trackers should announce the latest stats and send the completed event
+func TestTrackerManagerSendsStatsAndCompleted(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer ts.Close()
+	receive := func() url.Values {
+		select {
+		case q := <-queries:
+			return q
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an announce")
+		}
+		return nil
+	}
+
+	var m MetaInfo
+	m.Announce = ts.URL
+	tm := NewTrackerManager(6881)
+	tm.stats = Stats{Left: 1000}
+	go tm.Run(m, [][]byte{make([]byte, 20)})
+	defer tm.Stop()
+
+	q := receive()
+	if q.Get("event") != "started" || q.Get("left") != "1000" || q.Get("downloaded") != "0" {
+		t.Errorf("Unexpected started announce %v", q)
+	}
+	tm.peerChans.stats <- Stats{Left: 0, Uploaded: 300, Downloaded: 1200}
+	tm.peerChans.completed <- true
+	q = receive()
+	if q.Get("event") != "completed" || q.Get("left") != "0" || q.Get("uploaded") != "300" || q.Get("downloaded") != "1200" {
+		t.Errorf("Unexpected completed announce %v", q)
+	}
+}
+
+// Once the metadata of a magnet link says the torrent is private, only one
+// tracker may be used at a time even if every tier was being announced to
+func TestTrackerManagerTurnsPrivate(t *testing.T) {
+	announces := make(chan string, 10)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			announces <- name + " " + r.URL.Query().Get("event")
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		}))
+	}
+	first := newServer("first")
+	defer first.Close()
+	second := newServer("second")
+	defer second.Close()
+	receive := func() string {
+		select {
+		case announce := <-announces:
+			return announce
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for an announce")
+		}
+		return ""
+	}
+
+	var m MetaInfo
+	m.AnnounceList = [][]string{{first.URL}, {second.URL}}
+	tm := NewTrackerManager(6881)
+	tm.allTiers = true
+	go tm.Run(m, [][]byte{make([]byte, 20)})
+	defer tm.Stop()
+
+	started := map[string]bool{receive(): true, receive(): true}
+	if !started["first started"] || !started["second started"] {
+		t.Fatalf("Expected both tiers to be announced to, got %v", started)
+	}
+	tm.peerChans.private <- true
+
+	// The trackers of each tier are stopped, and a single one started
+	var restarted []string
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case announce := <-announces:
+			if !strings.HasSuffix(announce, " stopped") {
+				restarted = append(restarted, announce)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if len(restarted) != 1 || restarted[0] != "first started" {
+		t.Errorf("Expected a single tracker to announce to the first tier, got %v", restarted)
+	}
+}
+
+func TestAnnounceOptions(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali1800e5:peersle"))
+	}))
+	defer ts.Close()
+
+	base := AnnounceOptions{NumWant: 80, IP: "203.0.113.5", NoPeerID: true}
+	announce, options, err := parseTrackerOptions(ts.URL+"/announce#numwant=200, compact=0,supportcrypto=1", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if announce != ts.URL+"/announce" || options.NumWant != 200 || !options.NoCompact || !options.SupportCrypto || options.IP != base.IP {
+		t.Errorf("Unexpected tracker options %s %+v", announce, options)
+	}
+	for _, spec := range []string{ts.URL, ts.URL + "#numwant", ts.URL + "#ipv4=::1", ts.URL + "#bogus=1"} {
+		if _, _, err = parseTrackerOptions(spec, base); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{ts.URL + "/announce?passkey=s3cr3t"}}, false)
+	tr.options = base
+	tr.stats = Stats{Corrupt: 16384, Redundant: 32768}
+	tr.announce(tr.tiers[0][0], Started)
+	q := <-queries
+	if q.Get("passkey") != "s3cr3t" || q.Get("event") != "started" {
+		t.Errorf("Expected the announce URL's query to be kept, got %v", q)
+	}
+	if q.Get("numwant") != "80" || q.Get("ip") != "203.0.113.5" || q.Get("no_peer_id") != "1" || q.Get("compact") != "1" || q.Get("supportcrypto") != "" {
+		t.Errorf("Unexpected announce parameters %v", q)
+	}
+	if q.Get("corrupt") != "16384" || q.Get("redundant") != "32768" {
+		t.Errorf("Expected the corrupt and redundant bytes to be reported, got %v", q)
+	}
+
+	tr.urlOptions = map[string]AnnounceOptions{tr.tiers[0][0].String(): options}
+	tr.announce(tr.tiers[0][0], Interval)
+	q = <-queries
+	if q.Get("numwant") != "200" || q.Get("compact") != "0" || q.Get("supportcrypto") != "1" {
+		t.Errorf("Expected the options for the tracker to be used, got %v", q)
+	}
+}
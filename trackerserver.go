@@ -0,0 +1,481 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"launchpad.net/tomb"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Peers get this many peers when they don't ask for a number
+	trackerServerNumWant = 50
+	// and never more than this many
+	trackerServerMaxNumWant = 200
+)
+
+// swarmPeer is a peer that has announced a torrent to the TrackerServer
+type swarmPeer struct {
+	peerID   string
+	ip       net.IP
+	port     uint16
+	left     int
+	lastSeen time.Time
+}
+
+// swarm holds the peers of one torrent
+type swarm struct {
+	peers      map[string]*swarmPeer // by peer id
+	downloaded int                   // number of completed events
+}
+
+// counts returns the number of seeders and leechers in the swarm
+func (s *swarm) counts() (complete, incomplete int) {
+	for _, peer := range s.peers {
+		if peer.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return
+}
+
+// TrackerServer is an HTTP tracker that keeps its swarms in memory
+type TrackerServer struct {
+	Interval    time.Duration     // how often peers should announce
+	PeerTimeout time.Duration     // peers that haven't announced for this long are dropped
+	whitelist   map[string]bool   // info hashes that may be tracked, nil allows any
+	swarms      map[string]*swarm // by info hash
+	mutex       sync.Mutex
+	listener    net.Listener
+	t           tomb.Tomb
+}
+
+// NewTrackerServer returns a TrackerServer listening on addr. Only the info
+// hashes in the whitelist are tracked, unless it's empty.
+func NewTrackerServer(addr string, whitelist [][]byte) (*TrackerServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ts := new(TrackerServer)
+	ts.Interval = defaultAnnounceInterval
+	ts.PeerTimeout = 2 * defaultAnnounceInterval
+	ts.swarms = make(map[string]*swarm)
+	ts.listener = listener
+	if len(whitelist) > 0 {
+		ts.whitelist = make(map[string]bool)
+		for _, infoHash := range whitelist {
+			ts.whitelist[string(infoHash)] = true
+		}
+	}
+	log.Println("TrackerServer : Listening on", listener.Addr())
+	return ts, nil
+}
+
+// Addr returns the address that the TrackerServer is listening on
+func (ts *TrackerServer) Addr() net.Addr {
+	return ts.listener.Addr()
+}
+
+// writeBencoded writes a bencoded tracker response. Errors are reported
+// with a failure reason, so the status is always 200.
+func writeBencoded(w http.ResponseWriter, dict map[string]interface{}) {
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, dict); err != nil {
+		log.Println("TrackerServer : writeBencoded :", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b.Bytes())
+}
+
+// writeFailure answers a request with a failure reason
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]interface{}{"failure reason": reason})
+}
+
+// trackerResponseDict returns the dictionary that encodes a TrackerResponse.
+// The keys are the ones the tracker client decodes.
+func trackerResponseDict(resp TrackerResponse) map[string]interface{} {
+	dict := map[string]interface{}{
+		"interval":   resp.Interval,
+		"complete":   resp.Complete,
+		"incomplete": resp.Incomplete,
+	}
+	if resp.MinInterval > 0 {
+		dict["min interval"] = resp.MinInterval
+	}
+	if resp.WarningMessage != "" {
+		dict["warning message"] = resp.WarningMessage
+	}
+	if resp.TrackerId != "" {
+		dict["tracker id"] = resp.TrackerId
+	}
+	return dict
+}
+
+// ServeHTTP implements http.Handler
+func (ts *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		ts.announce(w, r)
+	case "/scrape":
+		ts.scrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// peerAddress returns the address to hand out for the peer making the
+// request. A peer on the local network may give its address in the ip
+// parameter, anyone else could use it to hand out the address of another
+// host.
+func peerAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	source := net.ParseIP(host)
+	if source == nil || !trustsClaimedAddress(source) {
+		return source
+	}
+	if ip := net.ParseIP(r.URL.Query().Get("ip")); ip != nil {
+		return ip
+	}
+	return source
+}
+
+// trustsClaimedAddress returns true if a peer announcing from source may
+// give another address for itself. Only local peers are trusted to.
+func trustsClaimedAddress(source net.IP) bool {
+	return source.IsLoopback() || source.IsPrivate()
+}
+
+// announceRequest is an announce received over HTTP or UDP
+type announceRequest struct {
+	infoHash string
+	peerID   string
+	ip       net.IP
+	port     uint16
+	left     int
+	event    int // Started, Completed, Stopped or Interval
+	numWant  int // negative for the default
+}
+
+// announcePeer adds, updates or removes the peer making the request and
+// returns the state of the swarm along with random peers for it
+func (ts *TrackerServer) announcePeer(req announceRequest) (resp TrackerResponse, peers []*swarmPeer, err error) {
+	numWant := req.numWant
+	if numWant < 0 {
+		numWant = trackerServerNumWant
+	}
+	if numWant > trackerServerMaxNumWant {
+		numWant = trackerServerMaxNumWant
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.whitelist != nil && !ts.whitelist[req.infoHash] {
+		return resp, nil, trackerFailure("unregistered torrent")
+	}
+	s, ok := ts.swarms[req.infoHash]
+	if !ok {
+		s = &swarm{peers: make(map[string]*swarmPeer)}
+		ts.swarms[req.infoHash] = s
+	}
+	switch req.event {
+	case Stopped:
+		delete(s.peers, req.peerID)
+	case Completed:
+		s.downloaded++
+		fallthrough
+	default:
+		s.peers[req.peerID] = &swarmPeer{peerID: req.peerID, ip: req.ip, port: req.port, left: req.left, lastSeen: time.Now()}
+	}
+
+	resp.Interval = int(ts.Interval / time.Second)
+	resp.Complete, resp.Incomplete = s.counts()
+
+	// Pick random peers other than the one asking. Seeders have no use for
+	// other seeders.
+	for _, peer := range s.peers {
+		if peer.peerID != req.peerID && (req.left > 0 || peer.left > 0) {
+			peers = append(peers, peer)
+		}
+	}
+	for i := range peers {
+		j := i + rand.Intn(len(peers)-i)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	return resp, peers, nil
+}
+
+// scrapeSwarm returns the statistics of a swarm, if it's being tracked
+func (ts *TrackerServer) scrapeSwarm(infoHash string) (result ScrapeResult, ok bool) {
+	s, ok := ts.swarms[infoHash]
+	if !ok {
+		return
+	}
+	result.Complete, result.Incomplete = s.counts()
+	result.Downloaded = s.downloaded
+	return
+}
+
+// compactPeers encodes the addresses of peers in the compact form, with
+// IPv4 and IPv6 peers separately (BEP 7)
+func compactPeers(peers []*swarmPeer) (peers4, peers6 []byte) {
+	for _, peer := range peers {
+		if ip4 := peer.ip.To4(); ip4 != nil {
+			peers4 = append(peers4, ip4...)
+			peers4 = append(peers4, byte(peer.port>>8), byte(peer.port))
+		} else {
+			peers6 = append(peers6, peer.ip.To16()...)
+			peers6 = append(peers6, byte(peer.port>>8), byte(peer.port))
+		}
+	}
+	return
+}
+
+// announce answers an HTTP announce
+func (ts *TrackerServer) announce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	req := announceRequest{infoHash: params.Get("info_hash"), peerID: params.Get("peer_id"), numWant: -1}
+	if len(req.infoHash) != 20 {
+		writeFailure(w, "invalid info_hash")
+		return
+	}
+	if len(req.peerID) != 20 {
+		writeFailure(w, "invalid peer_id")
+		return
+	}
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeFailure(w, "invalid port")
+		return
+	}
+	req.port = uint16(port)
+	req.left, err = strconv.Atoi(params.Get("left"))
+	if err != nil || req.left < 0 {
+		writeFailure(w, "invalid left")
+		return
+	}
+	if req.ip = peerAddress(r); req.ip == nil {
+		writeFailure(w, "unable to determine the peer's address")
+		return
+	}
+	if n, err := strconv.Atoi(params.Get("numwant")); err == nil && n >= 0 {
+		req.numWant = n
+	}
+	switch params.Get("event") {
+	case "started":
+		req.event = Started
+	case "completed":
+		req.event = Completed
+	case "stopped":
+		req.event = Stopped
+	default:
+		req.event = Interval
+	}
+
+	resp, peers, err := ts.announcePeer(req)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	dict := trackerResponseDict(resp)
+	if params.Get("compact") == "0" {
+		// A list of dictionaries
+		list := []interface{}{}
+		for _, peer := range peers {
+			p := map[string]interface{}{"ip": peer.ip.String(), "port": int(peer.port)}
+			if params.Get("no_peer_id") != "1" {
+				p["peer id"] = peer.peerID
+			}
+			list = append(list, p)
+		}
+		dict["peers"] = list
+	} else {
+		peers4, peers6 := compactPeers(peers)
+		dict["peers"] = string(peers4)
+		if len(peers6) > 0 {
+			dict["peers6"] = string(peers6)
+		}
+	}
+	writeBencoded(w, dict)
+}
+
+// scrape answers with the statistics of the requested swarms, or of every
+// swarm if none were requested
+func (ts *TrackerServer) scrape(w http.ResponseWriter, r *http.Request) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	infoHashes := r.URL.Query()["info_hash"]
+	if len(infoHashes) == 0 {
+		for infoHash := range ts.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	files := make(map[string]interface{})
+	for _, infoHash := range infoHashes {
+		if result, ok := ts.scrapeSwarm(infoHash); ok {
+			files[infoHash] = map[string]interface{}{
+				"complete":   result.Complete,
+				"downloaded": result.Downloaded,
+				"incomplete": result.Incomplete,
+			}
+		}
+	}
+	writeBencoded(w, map[string]interface{}{"files": files})
+}
+
+// expirePeers drops peers that haven't announced within the peer timeout,
+// and swarms that have no peers left
+func (ts *TrackerServer) expirePeers(now time.Time) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for infoHash, s := range ts.swarms {
+		for peerID, peer := range s.peers {
+			if now.Sub(peer.lastSeen) > ts.PeerTimeout {
+				delete(s.peers, peerID)
+			}
+		}
+		if len(s.peers) == 0 && s.downloaded == 0 {
+			delete(ts.swarms, infoHash)
+		}
+	}
+}
+
+// Stop stops this TrackerServer
+func (ts *TrackerServer) Stop() error {
+	log.Println("TrackerServer : Stop : Stopping")
+	ts.t.Kill(nil)
+	return ts.t.Wait()
+}
+
+// Run serves requests and expires peers until the TrackerServer is stopped
+func (ts *TrackerServer) Run() {
+	log.Println("TrackerServer : Run : Started")
+	defer ts.t.Done()
+	defer log.Println("TrackerServer : Run : Completed")
+
+	go func() {
+		err := http.Serve(ts.listener, ts)
+		select {
+		case <-ts.t.Dying():
+		default:
+			log.Println("TrackerServer : Run :", err)
+			ts.t.Kill(err)
+		}
+	}()
+
+	ticker := time.NewTicker(ts.PeerTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ts.expirePeers(now)
+		case <-ts.t.Dying():
+			ts.listener.Close()
+			return
+		}
+	}
+}
+
+// loadWhitelist reads info hashes from a file, one hex encoded hash per
+// line. Blank lines and lines starting with # are ignored.
+func loadWhitelist(filename string) (whitelist [][]byte, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		infoHash, err := hex.DecodeString(text)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("%s:%d: invalid info hash %q", filename, line, text)
+		}
+		whitelist = append(whitelist, infoHash)
+	}
+	return whitelist, scanner.Err()
+}
+
+// trackerMain implements the tracker subcommand
+func trackerMain(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := fs.String("addr", ":6969", "`address` to listen on for HTTP announces")
+	udpAddr := fs.String("udp", ":6969", "`address` to listen on for UDP announces (BEP 15), empty to disable")
+	udpRate := fs.Float64("udp-rate", udpTrackerServerRate, "UDP requests per second allowed from each address")
+	interval := fs.Duration("interval", defaultAnnounceInterval, "how often peers should announce")
+	whitelistFile := fs.String("whitelist", "", "only track the hex encoded info hashes in this `file`, one per line")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s tracker [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *interval <= 0 {
+		log.Fatal("-interval must be positive")
+	}
+
+	var whitelist [][]byte
+	if *whitelistFile != "" {
+		var err error
+		if whitelist, err = loadWhitelist(*whitelistFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ts, err := NewTrackerServer(*addr, whitelist)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts.Interval = *interval
+	ts.PeerTimeout = 2 * *interval
+	go ts.Run()
+	defer ts.Stop()
+	if *udpAddr != "" {
+		udp, err := NewUDPTrackerServer(*udpAddr, ts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		udp.Rate = *udpRate
+		go udp.Run()
+		defer udp.Stop()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// startTrackerServer runs a TrackerServer on a random local port and returns
+// its announce URL
+func startTrackerServer(t *testing.T, whitelist [][]byte) (*TrackerServer, string) {
+	ts, err := NewTrackerServer("127.0.0.1:0", whitelist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ts.Run()
+	return ts, "http://" + ts.Addr().String() + "/announce"
+}
+
+// rawAnnounce sends an announce with the given parameters and returns the
+// decoded response
+func rawAnnounce(t *testing.T, announce string, params url.Values) map[string]interface{} {
+	resp, err := http.Get(announce + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, _ := decoded.(map[string]interface{})
+	return dict
+}
+
+// peerParams returns the announce parameters of a test peer
+func peerParams(infoHash []byte, id byte, port string, left string) url.Values {
+	return url.Values{
+		"info_hash": {string(infoHash)},
+		"peer_id":   {string(bytes.Repeat([]byte{id}, 20))},
+		"port":      {port},
+		"left":      {left},
+		"ip":        {"10.0.0." + fmt.Sprint(id)},
+	}
+}
+
+func TestTrackerServerAnnounceAndScrape(t *testing.T) {
+	ts, announce := startTrackerServer(t, nil)
+	defer ts.Stop()
+	infoHash := bytes.Repeat([]byte{1}, 20)
+
+	// A seeder and a leecher join the swarm
+	seeder := peerParams(infoHash, 1, "6881", "0")
+	seeder.Set("event", "started")
+	if dict := rawAnnounce(t, announce, seeder); dict["peers"] != "" {
+		t.Errorf("Expected no peers for the first peer, got %v", dict)
+	}
+	leecher := peerParams(infoHash, 2, "6882", "100")
+	leecher.Set("compact", "0")
+	dict := rawAnnounce(t, announce, leecher)
+	peers, _ := dict["peers"].([]interface{})
+	if len(peers) != 1 || dict["complete"] != int64(1) || dict["incomplete"] != int64(1) {
+		t.Fatalf("Unexpected response %v", dict)
+	}
+	if peer, _ := peers[0].(map[string]interface{}); peer["ip"] != "10.0.0.1" || peer["port"] != int64(6881) || peer["peer id"] != seeder.Get("peer_id") {
+		t.Errorf("Unexpected peer %v", peers[0])
+	}
+
+	// The client understands the responses
+	chans := NewTrackerManager(6883).peerChans
+	tr := newTracker(initKey(), chans, 6883, infoHash, [][]string{{announce}}, false)
+	tr.stats.Left = 100
+	go tr.Announce(Started)
+	seen := make(map[uint16]bool)
+	for i := 0; i < 2; i++ {
+		seen[receivePeer(t, chans).Port] = true
+	}
+	if !seen[6881] || !seen[6882] {
+		t.Errorf("Expected both peers, got %v", seen)
+	}
+
+	leecher.Set("event", "completed")
+	leecher.Set("left", "0")
+	rawAnnounce(t, announce, leecher)
+	results, err := ScrapeTracker(announce, [][]byte{infoHash, bytes.Repeat([]byte{9}, 20)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[string(infoHash)]; r.Complete != 2 || r.Incomplete != 1 || r.Downloaded != 1 || len(results) != 1 {
+		t.Errorf("Unexpected scrape results %v", results)
+	}
+
+	seeder.Set("event", "stopped")
+	rawAnnounce(t, announce, seeder)
+	ts.expirePeers(time.Now().Add(ts.PeerTimeout + time.Second))
+	if len(ts.swarms[string(infoHash)].peers) != 0 {
+		t.Errorf("Expected every peer to be gone, got %v", ts.swarms[string(infoHash)].peers)
+	}
+}
+
+func TestTrackerServerWhitelist(t *testing.T) {
+	allowed := bytes.Repeat([]byte{0xab}, 20)
+	file, err := ioutil.TempFile("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# allowed torrents\n\nabababababababababababababababababababab\n")
+	file.Close()
+	whitelist, err := loadWhitelist(file.Name())
+	if err != nil || len(whitelist) != 1 || !bytes.Equal(whitelist[0], allowed) {
+		t.Fatalf("Unexpected whitelist %x (%v)", whitelist, err)
+	}
+
+	ts, announce := startTrackerServer(t, whitelist)
+	defer ts.Stop()
+	if dict := rawAnnounce(t, announce, peerParams(allowed, 1, "6881", "0")); dict["failure reason"] != nil {
+		t.Errorf("Expected a whitelisted torrent to be tracked, got %v", dict)
+	}
+	if dict := rawAnnounce(t, announce, peerParams(make([]byte, 20), 1, "6881", "0")); dict["failure reason"] != "unregistered torrent" {
+		t.Errorf("Expected other torrents to be refused, got %v", dict)
+	}
+	if dict := rawAnnounce(t, announce, url.Values{"info_hash": {string(allowed)}}); dict["failure reason"] == nil {
+		t.Errorf("Expected an announce without a peer id to be refused, got %v", dict)
+	}
+}
+
+// Only a local peer may give another address for itself
+func TestTrackerServerPeerAddress(t *testing.T) {
+	for remote, expected := range map[string]string{
+		"192.0.2.1:6881":   "192.0.2.1",
+		"127.0.0.1:6881":   "10.0.0.9",
+		"192.168.1.2:6881": "10.0.0.9",
+	} {
+		r := httptest.NewRequest("GET", "/announce?ip=10.0.0.9", nil)
+		r.RemoteAddr = remote
+		if ip := peerAddress(r); ip.String() != expected {
+			t.Errorf("Expected address %s for an announce from %s, got %v", expected, remote, ip)
+		}
+	}
+}
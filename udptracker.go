@@ -0,0 +1,280 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// A connection ID may be used for this long after it was received
+	udpConnectionIDLifetime = time.Minute
+)
+
+// Timeouts for UDP tracker requests. The timeout after n retransmissions
+// is udpTrackerTimeout * 2^n, up to n = udpTrackerRetries, unless the
+// request's context runs out first.
+var (
+	udpTrackerTimeout = 15 * time.Second
+	udpTrackerRetries = 8
+)
+
+var errUDPTimeout = errors.New("UDP tracker request timed out")
+
+// udpTrackerClient talks to a single UDP tracker
+type udpTrackerClient struct {
+	conn         net.Conn
+	connectionID uint64
+	connected    time.Time // when connectionID was received
+}
+
+// newUDPTrackerClient returns a client for the tracker at host, reached
+// through the proxy if there is one
+func newUDPTrackerClient(host string, proxy *Proxy) (*udpTrackerClient, error) {
+	conn, err := proxy.DialUDP(host)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTrackerClient{conn: conn}, nil
+}
+
+func (c *udpTrackerClient) Close() error {
+	return c.conn.Close()
+}
+
+// connect obtains a new connection ID from the tracker
+func (c *udpTrackerClient) connect(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, udpActionConnect, nil)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 8 {
+		return fmt.Errorf("connect response is too short (%d bytes)", len(resp))
+	}
+	c.connectionID = binary.BigEndian.Uint64(resp)
+	c.connected = time.Now()
+	return nil
+}
+
+// receive waits for a response with the given transaction ID. Packets with
+// any other transaction ID are ignored. Waiting stops early when ctx is
+// done.
+func (c *udpTrackerClient) receive(ctx context.Context, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	// Cut the read short when ctx is cancelled, and make sure that doesn't
+	// happen after we've returned
+	done := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-exited
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if ctx.Err() == context.Canceled {
+					return nil, ctx.Err()
+				}
+				return nil, errUDPTimeout
+			}
+			return nil, err
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+			continue
+		}
+		return buf[:n], nil
+	}
+}
+
+// roundTrip sends a request with the given action and returns the body of
+// the response that follows the action and transaction ID. Requests are
+// retransmitted following the BEP 15 timeout schedule, and a new connection
+// ID is obtained whenever the current one has expired. The whole exchange
+// is given up at the deadline of ctx, or as soon as it's cancelled.
+func (c *udpTrackerClient) roundTrip(ctx context.Context, action uint32, body []byte) ([]byte, error) {
+	for n := 0; n <= udpTrackerRetries; n++ {
+		switch ctx.Err() {
+		case context.Canceled:
+			return nil, ctx.Err()
+		case context.DeadlineExceeded:
+			return nil, errUDPTimeout
+		}
+		connectionID := uint64(udpProtocolID)
+		if action != udpActionConnect {
+			if time.Since(c.connected) > udpConnectionIDLifetime {
+				if err := c.connect(ctx); err != nil {
+					return nil, err
+				}
+			}
+			connectionID = c.connectionID
+		}
+
+		transactionID := rand.Uint32()
+		request := make([]byte, 16, 16+len(body))
+		binary.BigEndian.PutUint64(request, connectionID)
+		binary.BigEndian.PutUint32(request[8:], action)
+		binary.BigEndian.PutUint32(request[12:], transactionID)
+		if _, err := c.conn.Write(append(request, body...)); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.receive(ctx, transactionID, udpTrackerTimeout<<uint(n))
+		if err == errUDPTimeout {
+			log.Printf("UDPTracker : roundTrip : Timed out waiting for %s, retransmitting\n", c.conn.RemoteAddr())
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		switch binary.BigEndian.Uint32(resp) {
+		case action:
+			return resp[8:], nil
+		case udpActionError:
+			return nil, trackerFailure(resp[8:])
+		default:
+			return nil, fmt.Errorf("unexpected action %d in response", binary.BigEndian.Uint32(resp))
+		}
+	}
+	return nil, errUDPTimeout
+}
+
+// scrape returns the statistics for each of the info hashes
+func (c *udpTrackerClient) scrape(ctx context.Context, infoHashes [][]byte) ([]ScrapeResult, error) {
+	var body []byte
+	for _, infoHash := range infoHashes {
+		body = append(body, infoHash...)
+	}
+	resp, err := c.roundTrip(ctx, udpActionScrape, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12*len(infoHashes) {
+		return nil, fmt.Errorf("scrape response is too short (%d bytes)", len(resp))
+	}
+	results := make([]ScrapeResult, len(infoHashes))
+	for i := range results {
+		results[i].Complete = int(binary.BigEndian.Uint32(resp[12*i:]))
+		results[i].Downloaded = int(binary.BigEndian.Uint32(resp[12*i+4:]))
+		results[i].Incomplete = int(binary.BigEndian.Uint32(resp[12*i+8:]))
+	}
+	return results, nil
+}
+
+// udpClient returns the client for a UDP tracker, creating it if needed
+func (tr *tracker) udpClient(u *url.URL) (*udpTrackerClient, error) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	if client, ok := tr.udpClients[u.Host]; ok {
+		return client, nil
+	}
+	client, err := newUDPTrackerClient(u.Host, tr.proxy)
+	if err != nil {
+		return nil, err
+	}
+	if tr.udpClients == nil {
+		tr.udpClients = make(map[string]*udpTrackerClient)
+	}
+	tr.udpClients[u.Host] = client
+	return client, nil
+}
+
+// announceUDP sends an announce request to a UDP tracker and stores its
+// response in the same form as an HTTP tracker's response
+func (tr *tracker) announceUDP(ctx context.Context, u *url.URL, event int) error {
+	client, err := tr.udpClient(u)
+	if err != nil {
+		return err
+	}
+
+	body := make([]byte, 82)
+	copy(body, tr.infoHash)
+	copy(body[20:], PeerID)
+	stats := tr.currentStats()
+	binary.BigEndian.PutUint64(body[40:], uint64(stats.Downloaded))
+	binary.BigEndian.PutUint64(body[48:], uint64(stats.Left))
+	binary.BigEndian.PutUint64(body[56:], uint64(stats.Uploaded))
+	switch event {
+	case Completed:
+		binary.BigEndian.PutUint32(body[64:], 1)
+	case Started:
+		binary.BigEndian.PutUint32(body[64:], 2)
+	case Stopped:
+		binary.BigEndian.PutUint32(body[64:], 3)
+	}
+	// Without an IPv4 address to advertise the IP address is left as 0, so
+	// the tracker uses the address the request came from
+	options := tr.announceOptions(u)
+	for _, address := range []string{options.IP, options.IPv4} {
+		if ip := net.ParseIP(address).To4(); ip != nil {
+			copy(body[68:72], ip)
+			break
+		}
+	}
+	key, _ := hex.DecodeString(tr.key)
+	copy(body[72:76], key)
+	numWant := uint32(0xffffffff) // the tracker's default
+	if options.NumWant > 0 {
+		numWant = uint32(options.NumWant)
+	}
+	binary.BigEndian.PutUint32(body[76:], numWant)
+	binary.BigEndian.PutUint16(body[80:], tr.port)
+
+	log.Printf("Announce: %s\n", u.String())
+	resp, err := client.roundTrip(ctx, udpActionAnnounce, body)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 12 {
+		return fmt.Errorf("announce response is too short (%d bytes)", len(resp))
+	}
+	tr.response = TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(resp)),
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:])),
+	}
+
+	// Trackers reached over IPv6 return IPv6 peers
+	ipLen := net.IPv4len
+	host, _, _ := net.SplitHostPort(client.conn.RemoteAddr().String())
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	if tr.peers, err = parseCompactPeers(string(resp[12:]), ipLen); err != nil {
+		log.Println("UDPTracker : announceUDP : Ignoring partial peer:", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpTestTracker is a stand-in BEP 15 tracker
+type udpTestTracker struct {
+	conn     *net.UDPConn
+	mutex    sync.Mutex
+	drop     int    // number of requests to ignore before answering
+	fail     string // error message for every announce, if set
+	connects int
+	scrapes  int
+	ids      map[uint64]bool
+}
+
+func newUDPTestTracker(t *testing.T) *udpTestTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &udpTestTracker{conn: conn, ids: make(map[uint64]bool)}
+	go s.serve()
+	return s
+}
+
+// counts returns the number of connects and scrapes served so far
+func (s *udpTestTracker) counts() (connects, scrapes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connects, s.scrapes
+}
+
+func (s *udpTestTracker) url() *url.URL {
+	return &url.URL{Scheme: "udp", Host: s.conn.LocalAddr().String()}
+}
+
+func (s *udpTestTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(buf[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (s *udpTestTracker) handle(req []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(req)
+	action := binary.BigEndian.Uint32(req[8:])
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[4:], binary.BigEndian.Uint32(req[12:]))
+	fail := func(msg string) []byte {
+		binary.BigEndian.PutUint32(resp, udpActionError)
+		return append(resp, msg...)
+	}
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return fail("bad protocol ID")
+		}
+		s.connects++
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, uint64(1000+s.connects))
+		s.ids[binary.BigEndian.Uint64(id)] = true
+		binary.BigEndian.PutUint32(resp, udpActionConnect)
+		return append(resp, id...)
+	}
+	if !s.ids[connectionID] {
+		return fail("unknown connection ID")
+	}
+	binary.BigEndian.PutUint32(resp, action)
+	switch action {
+	case udpActionAnnounce:
+		if s.fail != "" {
+			return fail(s.fail)
+		}
+		if len(req) != 98 || binary.BigEndian.Uint16(req[96:]) != 6881 {
+			return fail("bad announce")
+		}
+		resp = append(resp, 0, 0, 0x07, 0x08, 0, 0, 0, 2, 0, 0, 0, 5)
+		return append(resp, 10, 0, 0, 1, 0x1a, 0xe1)
+	case udpActionScrape:
+		s.scrapes++
+		for i := 16; i < len(req); i += 20 {
+			resp = append(resp, 0, 0, 0, req[i], 0, 0, 0, 9, 0, 0, 0, 1)
+		}
+		return resp
+	}
+	return fail("unknown action")
+}
+
+func init() {
+	// Keep the tests fast
+	udpTrackerTimeout = 20 * time.Millisecond
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	s := newUDPTestTracker(t)
+	defer s.conn.Close()
+
+	chans := NewTrackerManager(6881).peerChans
+	tr := newTracker(initKey(), chans, 6881, make([]byte, 20), [][]string{{s.url().String()}}, false)
+	defer func() { tr.udpClients[s.url().Host].Close() }()
+
+	tr.Announce(Started)
+	peer := receivePeer(t, chans)
+	if peer.Port != 6881 || !peer.IP.Equal([]byte{10, 0, 0, 1}) {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+	if tr.response.Interval != 1800 || tr.response.Incomplete != 2 || tr.response.Complete != 5 {
+		t.Errorf("Unexpected response %+v", tr.response)
+	}
+
+	// The connection ID is reused until it expires
+	tr.announce(s.url(), Interval)
+	if connects, _ := s.counts(); connects != 1 {
+		t.Errorf("Expected a single connect but got %d", connects)
+	}
+	tr.udpClients[s.url().Host].connected = time.Now().Add(-2 * udpConnectionIDLifetime)
+	if err := tr.announce(s.url(), Interval); err != nil {
+		t.Error(err)
+	}
+	if connects, _ := s.counts(); connects != 2 {
+		t.Errorf("Expected an expired connection ID to be replaced, got %d connects", connects)
+	}
+}
+
+func TestUDPTrackerRetransmitsAndErrors(t *testing.T) {
+	s := newUDPTestTracker(t)
+	defer s.conn.Close()
+	client, err := newUDPTrackerClient(s.conn.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	s.mutex.Lock()
+	s.drop = 2
+	s.mutex.Unlock()
+	results, err := client.scrape(context.Background(), [][]byte{bytes.Repeat([]byte{3}, 20), bytes.Repeat([]byte{4}, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Complete != 3 || results[1].Complete != 4 || results[1].Downloaded != 9 || results[1].Incomplete != 1 {
+		t.Errorf("Unexpected scrape results %+v", results)
+	}
+
+	s.mutex.Lock()
+	s.fail = "torrent not registered"
+	s.mutex.Unlock()
+	tr := &tracker{infoHash: make([]byte, 20), key: initKey(), port: 6881, udpClients: map[string]*udpTrackerClient{s.url().Host: client}}
+	if err = tr.announceUDP(context.Background(), s.url(), Started); err == nil || err.Error() != "torrent not registered" {
+		t.Errorf("Expected the error from the tracker but got %v", err)
+	}
+
+	retries := udpTrackerRetries
+	udpTrackerRetries = 1
+	defer func() { udpTrackerRetries = retries }()
+	s.mutex.Lock()
+	s.drop = 100
+	s.mutex.Unlock()
+	client.connected = time.Time{}
+	if err = client.connect(context.Background()); err != errUDPTimeout {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+}
+
+// A tracker that doesn't answer shouldn't hold up an exchange past its
+// deadline, or stopping the tracker
+func TestUDPTrackerDeadline(t *testing.T) {
+	s := newUDPTestTracker(t)
+	defer s.conn.Close()
+	s.mutex.Lock()
+	s.drop = 1000
+	s.mutex.Unlock()
+	client, err := newUDPTrackerClient(s.conn.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Without the deadline the retransmissions would take seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = client.scrape(ctx, [][]byte{make([]byte, 20)}); err != errUDPTimeout {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the scrape to give up at the deadline, took %v", elapsed)
+	}
+
+	tr := newTracker(initKey(), NewTrackerManager(6881).peerChans, 6881, make([]byte, 20), [][]string{{s.url().String()}}, false)
+	go tr.Run()
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	tr.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected stopping to abandon the announce, took %v", elapsed)
+	}
+}
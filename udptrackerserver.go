@@ -0,0 +1,289 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"launchpad.net/tomb"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// Each address may send this many requests per second on average
+	udpTrackerServerRate = 10
+	// and this many at once
+	udpTrackerServerBurst = 50
+	// The largest number of info hashes answered in one scrape (BEP 15)
+	udpTrackerServerMaxScrape = 74
+)
+
+// rateBucket is a token bucket that limits the requests from one address
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket if there is one, after refilling it
+// for the time since the last request
+func (b *rateBucket) allow(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// UDPTrackerServer serves the swarms of a TrackerServer over the UDP
+// tracker protocol (BEP 15). Connection IDs are an HMAC of the client's
+// address and the current minute, so they don't need to be stored.
+type UDPTrackerServer struct {
+	Rate        float64 // requests per second allowed from each address
+	Burst       int     // requests allowed at once from each address
+	tracker     *TrackerServer
+	conn        *net.UDPConn
+	secret      []byte
+	buckets     map[string]*rateBucket // by IP address, only used by serve
+	lastCleanup time.Time
+	t           tomb.Tomb
+}
+
+// NewUDPTrackerServer returns a UDPTrackerServer listening on addr
+func NewUDPTrackerServer(addr string, tracker *TrackerServer) (*UDPTrackerServer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := new(UDPTrackerServer)
+	s.Rate = udpTrackerServerRate
+	s.Burst = udpTrackerServerBurst
+	s.tracker = tracker
+	s.conn = conn
+	s.secret = make([]byte, 32)
+	if _, err = rand.Read(s.secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.buckets = make(map[string]*rateBucket)
+	log.Println("UDPTrackerServer : Listening on", conn.LocalAddr())
+	return s, nil
+}
+
+// Addr returns the address that the UDPTrackerServer is listening on
+func (s *UDPTrackerServer) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// connectionID returns the connection ID issued to ip during the given
+// minute
+func (s *UDPTrackerServer) connectionID(ip net.IP, minute int64) uint64 {
+	mac := hmac.New(sha256.New, s.secret)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(minute))
+	mac.Write(buf[:])
+	mac.Write(ip.To16())
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionID returns true if id was issued to ip during this or the
+// previous minute. Clients may use a connection ID for a minute.
+func (s *UDPTrackerServer) validConnectionID(id uint64, ip net.IP, now time.Time) bool {
+	minute := now.Unix() / int64(udpConnectionIDLifetime/time.Second)
+	return id == s.connectionID(ip, minute) || id == s.connectionID(ip, minute-1)
+}
+
+// allow applies the rate limit to a request from ip. Buckets that have
+// filled up again are dropped once a minute to bound their number.
+func (s *UDPTrackerServer) allow(ip net.IP, now time.Time) bool {
+	if now.Sub(s.lastCleanup) > time.Minute {
+		for key, b := range s.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*s.Rate >= float64(s.Burst) {
+				delete(s.buckets, key)
+			}
+		}
+		s.lastCleanup = now
+	}
+	b, ok := s.buckets[string(ip.To16())]
+	if !ok {
+		b = &rateBucket{tokens: float64(s.Burst), last: now}
+		s.buckets[string(ip.To16())] = b
+	}
+	return b.allow(now, s.Rate, s.Burst)
+}
+
+// udpResponse starts a response with the action and transaction ID
+func udpResponse(action uint32, transactionID uint32) []byte {
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp, action)
+	binary.BigEndian.PutUint32(resp[4:], transactionID)
+	return resp
+}
+
+// udpError returns an error response with the given message
+func udpError(transactionID uint32, message string) []byte {
+	return append(udpResponse(udpActionError, transactionID), message...)
+}
+
+// handle returns the response to a request from addr, or nil if the
+// request should be ignored
+func (s *UDPTrackerServer) handle(req []byte, addr *net.UDPAddr, now time.Time) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(req)
+	action := binary.BigEndian.Uint32(req[8:])
+	transactionID := binary.BigEndian.Uint32(req[12:])
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		resp := udpResponse(udpActionConnect, transactionID)
+		minute := now.Unix() / int64(udpConnectionIDLifetime/time.Second)
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], s.connectionID(addr.IP, minute))
+		return append(resp, id[:]...)
+	}
+	if !s.validConnectionID(connectionID, addr.IP, now) {
+		return udpError(transactionID, "invalid connection ID")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		return s.announce(req, addr, transactionID)
+	case udpActionScrape:
+		return s.scrape(req, transactionID)
+	}
+	return udpError(transactionID, "unknown action")
+}
+
+// announce answers an announce request. Peers of the same address family
+// as the client are returned.
+func (s *UDPTrackerServer) announce(req []byte, addr *net.UDPAddr, transactionID uint32) []byte {
+	if len(req) < 98 {
+		return udpError(transactionID, "announce request is too short")
+	}
+	r := announceRequest{
+		infoHash: string(req[16:36]),
+		peerID:   string(req[36:56]),
+		ip:       addr.IP,
+		numWant:  int(int32(binary.BigEndian.Uint32(req[92:]))),
+		port:     binary.BigEndian.Uint16(req[96:]),
+	}
+	if r.port == 0 {
+		return udpError(transactionID, "invalid port")
+	}
+	left := binary.BigEndian.Uint64(req[64:])
+	if left > uint64(^uint(0)>>1) {
+		return udpError(transactionID, "invalid left")
+	}
+	r.left = int(left)
+	switch binary.BigEndian.Uint32(req[80:]) {
+	case 1:
+		r.event = Completed
+	case 2:
+		r.event = Started
+	case 3:
+		r.event = Stopped
+	default:
+		r.event = Interval
+	}
+	// A local IPv4 client may give another address to hand out
+	if ip := net.IP(req[84:88]); addr.IP.To4() != nil && trustsClaimedAddress(addr.IP) && !ip.Equal(net.IPv4zero) {
+		r.ip = net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	}
+
+	result, peers, err := s.tracker.announcePeer(r)
+	if err != nil {
+		return udpError(transactionID, err.Error())
+	}
+	resp := udpResponse(udpActionAnnounce, transactionID)
+	var counts [12]byte
+	binary.BigEndian.PutUint32(counts[:], uint32(result.Interval))
+	binary.BigEndian.PutUint32(counts[4:], uint32(result.Incomplete))
+	binary.BigEndian.PutUint32(counts[8:], uint32(result.Complete))
+	resp = append(resp, counts[:]...)
+	peers4, peers6 := compactPeers(peers)
+	if addr.IP.To4() != nil {
+		return append(resp, peers4...)
+	}
+	return append(resp, peers6...)
+}
+
+// scrape answers a scrape request. Swarms that aren't tracked are reported
+// as empty.
+func (s *UDPTrackerServer) scrape(req []byte, transactionID uint32) []byte {
+	n := (len(req) - 16) / 20
+	if n > udpTrackerServerMaxScrape {
+		n = udpTrackerServerMaxScrape
+	}
+	resp := udpResponse(udpActionScrape, transactionID)
+	s.tracker.mutex.Lock()
+	defer s.tracker.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		result, _ := s.tracker.scrapeSwarm(string(req[16+20*i : 36+20*i]))
+		var counts [12]byte
+		binary.BigEndian.PutUint32(counts[:], uint32(result.Complete))
+		binary.BigEndian.PutUint32(counts[4:], uint32(result.Downloaded))
+		binary.BigEndian.PutUint32(counts[8:], uint32(result.Incomplete))
+		resp = append(resp, counts[:]...)
+	}
+	return resp
+}
+
+// serve reads requests until the connection is closed
+func (s *UDPTrackerServer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.t.Dying():
+			default:
+				log.Println("UDPTrackerServer : serve :", err)
+				s.t.Kill(err)
+			}
+			return
+		}
+		now := time.Now()
+		if !s.allow(addr.IP, now) {
+			continue
+		}
+		if resp := s.handle(buf[:n], addr, now); resp != nil {
+			s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// Stop stops this UDPTrackerServer
+func (s *UDPTrackerServer) Stop() error {
+	log.Println("UDPTrackerServer : Stop : Stopping")
+	s.t.Kill(nil)
+	return s.t.Wait()
+}
+
+// Run serves requests until the UDPTrackerServer is stopped
+func (s *UDPTrackerServer) Run() {
+	log.Println("UDPTrackerServer : Run : Started")
+	defer s.t.Done()
+	defer log.Println("UDPTrackerServer : Run : Completed")
+
+	go s.serve()
+	<-s.t.Dying()
+	s.conn.Close()
+}
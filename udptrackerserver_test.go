@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUDPTrackerServerAnnounceAndScrape(t *testing.T) {
+	ts, announce := startTrackerServer(t, nil)
+	defer ts.Stop()
+	s, err := NewUDPTrackerServer("127.0.0.1:0", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Run()
+	defer s.Stop()
+
+	// A seeder announces over HTTP, a leecher over UDP
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	rawAnnounce(t, announce, peerParams(infoHash, 1, "6881", "0"))
+	udpURL := &url.URL{Scheme: "udp", Host: s.Addr().String()}
+	chans := NewTrackerManager(6882).peerChans
+	tr := newTracker(initKey(), chans, 6882, infoHash, [][]string{{udpURL.String()}}, false)
+	defer func() { tr.udpClients[udpURL.Host].Close() }()
+	tr.stats.Left = 100
+
+	go tr.Announce(Started)
+	peer := receivePeer(t, chans)
+	if peer.Port != 6881 || !peer.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Unexpected peer %v", peer)
+	}
+	if tr.response.Complete != 1 || tr.response.Incomplete != 1 || tr.response.Interval != 1800 {
+		t.Errorf("Unexpected response %+v", tr.response)
+	}
+
+	results, err := tr.udpClients[udpURL.Host].scrape(context.Background(), [][]byte{infoHash, make([]byte, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Complete != 1 || results[0].Incomplete != 1 || results[1] != (ScrapeResult{}) {
+		t.Errorf("Unexpected scrape results %+v", results)
+	}
+}
+
+func TestUDPTrackerServerConnectionIDs(t *testing.T) {
+	s := &UDPTrackerServer{secret: []byte("secret"), tracker: &TrackerServer{swarms: make(map[string]*swarm)}}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	now := time.Now()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req, udpProtocolID)
+	binary.BigEndian.PutUint32(req[12:], 42)
+	resp := s.handle(req, addr, now)
+	if len(resp) != 16 || binary.BigEndian.Uint32(resp[4:]) != 42 {
+		t.Fatalf("Unexpected connect response %x", resp)
+	}
+	id := binary.BigEndian.Uint64(resp[8:])
+
+	if !s.validConnectionID(id, addr.IP, now.Add(udpConnectionIDLifetime)) {
+		t.Errorf("Expected the connection ID to be valid for a minute")
+	}
+	if s.validConnectionID(id, addr.IP, now.Add(2*udpConnectionIDLifetime)) {
+		t.Errorf("Expected the connection ID to expire")
+	}
+	if s.validConnectionID(id, net.IPv4(10, 0, 0, 2), now) {
+		t.Errorf("Expected the connection ID to be tied to the address")
+	}
+	binary.BigEndian.PutUint64(req, id+1)
+	binary.BigEndian.PutUint32(req[8:], udpActionScrape)
+	if resp = s.handle(req, addr, now); binary.BigEndian.Uint32(resp) != udpActionError {
+		t.Errorf("Expected an error for an invalid connection ID, got %x", resp)
+	}
+}
+
+// An announce without a port can't be handed out to other peers
+func TestUDPTrackerServerRejectsPortZero(t *testing.T) {
+	s := &UDPTrackerServer{secret: []byte("secret"), tracker: &TrackerServer{swarms: make(map[string]*swarm)}}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:], 42)
+	if resp := s.announce(req, addr, 42); binary.BigEndian.Uint32(resp) != udpActionError {
+		t.Errorf("Expected an error for port 0, got %x", resp)
+	}
+	if len(s.tracker.swarms) != 0 {
+		t.Errorf("Expected the peer not to be tracked")
+	}
+}
+
+func TestRateBucket(t *testing.T) {
+	now := time.Now()
+	b := &rateBucket{tokens: 2, last: now}
+	if !b.allow(now, 1, 2) || !b.allow(now, 1, 2) {
+		t.Errorf("Expected a burst of 2 requests to be allowed")
+	}
+	if b.allow(now, 1, 2) {
+		t.Errorf("Expected a third request to be refused")
+	}
+	if !b.allow(now.Add(time.Second), 1, 2) {
+		t.Errorf("Expected a request to be allowed after the bucket refilled")
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Size of the blocks that form the leaves of a v2 merkle tree
+const merkleBlockSize = 16384
+
+// FileTreeEntry is a single file from a v2 (BEP 52) file tree
+type FileTreeEntry struct {
+	Path       []string
+	Length     int
+	PiecesRoot string // SHA-256 merkle root, empty for zero length files
+}
+
+// V2Info holds the BitTorrent v2 parts of a metainfo file that don't fit
+// in the v1 MetaInfo structure
+type V2Info struct {
+	FileTree    []FileTreeEntry
+	PieceLayers map[string]string // pieces root -> concatenated piece hashes
+}
+
+// numPieces returns the number of pieces a file of the given length spans
+func numPieces(length int, pieceLength int) int {
+	return (length + pieceLength - 1) / pieceLength
+}
+
+// parseFileTree flattens a decoded v2 file tree into a list of files in
+// lexical path order
+func parseFileTree(tree map[string]interface{}, path []string) (files []FileTreeEntry, err error) {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree node %q is not a dictionary", strings.Join(append(path, key), "/"))
+		}
+		if key == "" {
+			// A file is a dictionary with a single empty key
+			if len(path) == 0 || len(tree) != 1 {
+				return nil, errors.New("file tree entry has both a file and a directory")
+			}
+			length, ok := node["length"].(int64)
+			if !ok {
+				return nil, fmt.Errorf("file %q has no length", strings.Join(path, "/"))
+			}
+			root, _ := node["pieces root"].(string)
+			entry := FileTreeEntry{Path: append([]string(nil), path...), Length: int(length), PiecesRoot: root}
+			return []FileTreeEntry{entry}, nil
+		}
+		sub, err := parseFileTree(node, append(path, key))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return
+}
+
+// parseV2Info extracts the file tree from the raw info dictionary and the
+// piece layers from the raw metainfo file
+func parseV2Info(buf []byte, info []byte) (*V2Info, error) {
+	m, err := bencode.Decode(bytes.NewReader(info))
+	if err != nil {
+		return nil, err
+	}
+	tree, ok := m.(map[string]interface{})["file tree"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("file tree is missing")
+	}
+	v2 := new(V2Info)
+	if v2.FileTree, err = parseFileTree(tree, nil); err != nil {
+		return nil, err
+	}
+
+	v2.PieceLayers = make(map[string]string)
+	if m, err = bencode.Decode(bytes.NewReader(buf)); err != nil {
+		return nil, err
+	}
+	layers, _ := m.(map[string]interface{})["piece layers"].(map[string]interface{})
+	for root, layer := range layers {
+		s, ok := layer.(string)
+		if !ok {
+			return nil, errors.New("piece layer is not a string")
+		}
+		v2.PieceLayers[root] = s
+	}
+	return v2, nil
+}
+
+// merkleRoot computes the root of a merkle tree with the given hashes as
+// its bottom layer, padded to width entries with pad. Each layer above is
+// padded with the hash of two pads from the layer below.
+func merkleRoot(hashes [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			h := sha256.New()
+			h.Write(layer[2*i])
+			h.Write(layer[2*i+1])
+			next[i] = h.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// nextPowerOfTwo returns the smallest power of two that is >= n
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// blockHashes returns the SHA-256 hash of each 16 KiB block of buf
+func blockHashes(buf []byte) (hashes [][]byte) {
+	for i := 0; i < len(buf); i += merkleBlockSize {
+		end := i + merkleBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		h := sha256.Sum256(buf[i:end])
+		hashes = append(hashes, h[:])
+	}
+	return
+}
+
+// pieceHash returns the root of the merkle subtree covering one piece. The
+// subtree always covers a full piece length, padded with zero hashes.
+func pieceHash(buf []byte, pieceLength int) []byte {
+	return merkleRoot(blockHashes(buf), pieceLength/merkleBlockSize, make([]byte, sha256.Size))
+}
+
+// pieceLayerRoot computes the pieces root of a file from its piece layer
+func pieceLayerRoot(layer string, pieceLength int) []byte {
+	var hashes [][]byte
+	for i := 0; i < len(layer); i += sha256.Size {
+		hashes = append(hashes, []byte(layer[i:i+sha256.Size]))
+	}
+	// Pad with the root of a piece sized subtree of zero hashes
+	pad := pieceHash(nil, pieceLength)
+	return merkleRoot(hashes, nextPowerOfTwo(len(hashes)), pad)
+}
+
+// validateV2 checks the v2 file tree and piece layers for consistency
+func validateV2(m *MetaInfo, v2 *V2Info) error {
+	pieceLength := m.Info.PieceLength
+	if pieceLength < merkleBlockSize || pieceLength&(pieceLength-1) != 0 {
+		return validationErrorf("piece length", "must be a power of two of at least %d, got %d", merkleBlockSize, pieceLength)
+	}
+	if len(v2.FileTree) == 0 {
+		return validationErrorf("file tree", "no files present")
+	}
+	for _, file := range v2.FileTree {
+		name := strings.Join(file.Path, "/")
+		for _, component := range file.Path {
+			if err := validatePathComponent("file tree", component); err != nil {
+				return err
+			}
+		}
+		if file.Length < 0 {
+			return validationErrorf("file tree", "%s has negative length %d", name, file.Length)
+		}
+		if file.Length == 0 {
+			continue
+		}
+		if len(file.PiecesRoot) != sha256.Size {
+			return validationErrorf("file tree", "%s has an invalid pieces root", name)
+		}
+		if file.Length <= pieceLength {
+			continue
+		}
+		layer, ok := v2.PieceLayers[file.PiecesRoot]
+		if !ok {
+			return validationErrorf("piece layers", "missing for %s", name)
+		}
+		if len(layer) != numPieces(file.Length, pieceLength)*sha256.Size {
+			return validationErrorf("piece layers", "%s has %d bytes of hashes, expected %d", name, len(layer), numPieces(file.Length, pieceLength)*sha256.Size)
+		}
+		if !bytes.Equal(pieceLayerRoot(layer, pieceLength), []byte(file.PiecesRoot)) {
+			return validationErrorf("piece layers", "%s does not match its pieces root", name)
+		}
+	}
+	return nil
+}
+
+// validateHybrid checks that the v1 and v2 parts of a hybrid torrent
+// describe the same files and pieces
+func validateHybrid(m *MetaInfo, v2 *V2Info) error {
+	var files []FileDict
+	if len(m.Info.Files) > 0 {
+		for _, file := range m.Info.Files {
+			if !file.isPad() {
+				files = append(files, file)
+			}
+		}
+	} else {
+		files = []FileDict{{Length: m.Info.Length, Path: []string{m.Info.Name}}}
+	}
+	if len(files) != len(v2.FileTree) {
+		return validationErrorf("files", "%d v1 files but %d v2 files", len(files), len(v2.FileTree))
+	}
+	for i, file := range files {
+		if strings.Join(file.Path, "/") != strings.Join(v2.FileTree[i].Path, "/") || file.Length != v2.FileTree[i].Length {
+			return validationErrorf(fmt.Sprintf("files[%d]", i), "does not match the v2 file tree")
+		}
+	}
+
+	// Pad files align every file to a piece boundary, so both versions
+	// must have the same pieces
+	count := 0
+	for _, file := range v2.FileTree {
+		count += numPieces(file.Length, m.Info.PieceLength)
+	}
+	if count != len(m.Info.Pieces)/20 {
+		return validationErrorf("pieces", "%d v1 pieces but %d v2 pieces", len(m.Info.Pieces)/20, count)
+	}
+	return nil
+}
+
+// setV1Layout fills in the v1 Length or Files fields from the v2 file tree
+// so that a v2 only torrent can be laid out on disk the same way
+func setV1Layout(m *MetaInfo, v2 *V2Info) {
+	if len(v2.FileTree) == 1 && len(v2.FileTree[0].Path) == 1 && v2.FileTree[0].Path[0] == m.Info.Name {
+		m.Info.Length = v2.FileTree[0].Length
+		return
+	}
+	m.Info.Files = nil
+	for _, file := range v2.FileTree {
+		m.Info.Files = append(m.Info.Files, FileDict{Length: file.Length, Path: file.Path})
+	}
+}
+
+// hasPieceLayers returns true if the piece layer of every file larger than a
+// piece is known
+func (v2 *V2Info) hasPieceLayers(pieceLength int) bool {
+	for _, file := range v2.FileTree {
+		if _, ok := v2.PieceLayers[file.PiecesRoot]; file.Length > pieceLength && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMerkleHash verifies a piece of a file in a v2 torrent. Pieces never
+// span files, so the piece number is relative to the start of the file.
+// Without the file's piece layer, as in metadata fetched for a magnet link,
+// the piece can't be verified.
+func (v2 *V2Info) checkMerkleHash(buf []byte, fileIndex int, piece int, pieceLength int) bool {
+	file := v2.FileTree[fileIndex]
+	if file.Length <= pieceLength {
+		// The pieces root of a file no larger than one piece is the root
+		// of the tree over its blocks
+		width := nextPowerOfTwo(numPieces(file.Length, merkleBlockSize))
+		root := merkleRoot(blockHashes(buf), width, make([]byte, sha256.Size))
+		return bytes.Equal(root, []byte(file.PiecesRoot))
+	}
+	layer := v2.PieceLayers[file.PiecesRoot]
+	if len(layer) < (piece+1)*sha256.Size {
+		return false
+	}
+	return bytes.Equal(pieceHash(buf, pieceLength), []byte(layer[piece*sha256.Size:(piece+1)*sha256.Size]))
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testV2File returns the pieces root and piece layer of a file's contents
+func testV2File(content []byte, pieceLength int) (root string, layer string) {
+	if len(content) <= pieceLength {
+		width := nextPowerOfTwo(numPieces(len(content), merkleBlockSize))
+		return string(merkleRoot(blockHashes(content), width, make([]byte, sha256.Size))), ""
+	}
+	for i := 0; i < len(content); i += pieceLength {
+		end := i + pieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		layer += string(pieceHash(content[i:end], pieceLength))
+	}
+	return string(pieceLayerRoot(layer, pieceLength)), layer
+}
+
+func TestMerkleRoot(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	zero := make([]byte, sha256.Size)
+
+	if root := merkleRoot([][]byte{a[:]}, 1, zero); !bytes.Equal(root, a[:]) {
+		t.Errorf("Root of a single leaf should be the leaf itself")
+	}
+	ab := sha256.Sum256(append(a[:], b[:]...))
+	if root := merkleRoot([][]byte{a[:], b[:]}, 2, zero); !bytes.Equal(root, ab[:]) {
+		t.Errorf("Unexpected root of two leaves %x", root)
+	}
+	// Three leaves are padded to four with a zero hash
+	bz := sha256.Sum256(append(b[:], zero...))
+	abbz := sha256.Sum256(append(ab[:], bz[:]...))
+	if root := merkleRoot([][]byte{a[:], b[:], b[:]}, 4, zero); !bytes.Equal(root, abbz[:]) {
+		t.Errorf("Unexpected root of three leaves %x", root)
+	}
+}
+
+func TestParseV2TorrentAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pieceLength := 32768
+	small := bytes.Repeat([]byte{'s'}, 20000)
+	large := bytes.Repeat([]byte{'l'}, 80000)
+	smallRoot, _ := testV2File(small, pieceLength)
+	largeRoot, largeLayer := testV2File(large, pieceLength)
+
+	info := map[string]interface{}{
+		"name":         "v2test",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"dir": map[string]interface{}{
+				"large.bin": map[string]interface{}{"": map[string]interface{}{"length": len(large), "pieces root": largeRoot}},
+			},
+			"small.bin": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": smallRoot}},
+		},
+	}
+	name := writeTestTorrent(t, map[string]interface{}{
+		"info":         info,
+		"piece layers": map[string]interface{}{largeRoot: largeLayer},
+	})
+	defer os.Remove(name)
+
+	torrent, err := ParseTorrentFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(torrent.infoHashV2) != 32 || !bytes.Equal(torrent.infoHash, torrent.infoHashV2[:20]) {
+		t.Errorf("Expected the info hash to be the truncated v2 info hash, got %x and %x", torrent.infoHash, torrent.infoHashV2)
+	}
+	files := torrent.metaInfo.Info.Files
+	if len(files) != 2 || filepath.Join(files[0].Path...) != filepath.Join("dir", "large.bin") || files[1].Length != len(small) {
+		t.Fatalf("Unexpected v1 layout %+v", files)
+	}
+
+	// Write the large file completely and the small file partially
+	largeFile, _ := os.Create(filepath.Join(dir, "large.bin"))
+	largeFile.Write(large)
+	smallFile, _ := os.Create(filepath.Join(dir, "small.bin"))
+	smallFile.Write(small[:100])
+	defer largeFile.Close()
+	defer smallFile.Close()
+
+	diskio := NewDiskIO(torrent.metaInfo, torrent.v2, ControllerDiskIOChans{})
+	diskio.files = []*os.File{largeFile, smallFile}
+	finished := diskio.Verify()
+	expected := []bool{true, true, true, false}
+	if len(finished) != len(expected) {
+		t.Fatalf("Expected %d pieces but got %d", len(expected), len(finished))
+	}
+	for i := range expected {
+		if finished[i] != expected[i] {
+			t.Errorf("Expected piece %d finished to be %t", i, expected[i])
+		}
+	}
+}
+
+func TestParseV2TorrentInvalidPieceLayer(t *testing.T) {
+	pieceLength := 16384
+	large := bytes.Repeat([]byte{'l'}, 40000)
+	root, layer := testV2File(large, pieceLength)
+	info := map[string]interface{}{
+		"name":         "v2test",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"large.bin": map[string]interface{}{"": map[string]interface{}{"length": len(large), "pieces root": root}},
+		},
+	}
+
+	for _, layers := range []map[string]interface{}{
+		{},
+		{root: layer[:64]},
+		{root: string(bytes.Repeat([]byte{'x'}, len(layer)))},
+	} {
+		name := writeTestTorrent(t, map[string]interface{}{"info": info, "piece layers": layers})
+		_, err := ParseTorrentFile(name)
+		os.Remove(name)
+		if verr, ok := err.(*ValidationError); !ok || verr.Field != "piece layers" {
+			t.Errorf("Expected a piece layers validation error but got %v", err)
+		}
+	}
+}
+
+// buildHybridTorrent returns the metainfo of a hybrid torrent with two
+// files, where the first is followed by a pad file
+func buildHybridTorrent(first []byte, second []byte, pieceLength int) map[string]interface{} {
+	firstRoot, firstLayer := testV2File(first, pieceLength)
+	secondRoot, _ := testV2File(second, pieceLength)
+
+	padLength := pieceLength - len(first)%pieceLength
+	content := append(append(append([]byte(nil), first...), make([]byte, padLength)...), second...)
+	var pieces []byte
+	for i := 0; i < len(content); i += pieceLength {
+		end := i + pieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		h := sha1.Sum(content[i:end])
+		pieces = append(pieces, h[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         "hybrid",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"pieces":       string(pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": len(first), "path": []string{"a.bin"}},
+			map[string]interface{}{"length": padLength, "path": []string{".pad", fmt.Sprint(padLength)}, "attr": "p"},
+			map[string]interface{}{"length": len(second), "path": []string{"b.bin"}},
+		},
+		"file tree": map[string]interface{}{
+			"a.bin": map[string]interface{}{"": map[string]interface{}{"length": len(first), "pieces root": firstRoot}},
+			"b.bin": map[string]interface{}{"": map[string]interface{}{"length": len(second), "pieces root": secondRoot}},
+		},
+	}
+	return map[string]interface{}{
+		"info":         info,
+		"piece layers": map[string]interface{}{firstRoot: firstLayer},
+	}
+}
+
+func TestParseHybridTorrentAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pieceLength := 16384
+	first := bytes.Repeat([]byte{'a'}, 20000)
+	second := bytes.Repeat([]byte{'b'}, 5000)
+	name := writeTestTorrent(t, buildHybridTorrent(first, second, pieceLength))
+	defer os.Remove(name)
+
+	torrent, err := ParseTorrentFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha1.Sum(torrent.infoBytes)
+	if !bytes.Equal(torrent.infoHash, h[:]) {
+		t.Errorf("Expected the v1 info hash for a hybrid torrent")
+	}
+	hashes := torrent.infoHashes()
+	if len(hashes) != 2 || !bytes.Equal(hashes[1], torrent.infoHashV2[:20]) {
+		t.Errorf("Expected both info hashes for a hybrid torrent, got %x", hashes)
+	}
+	torrent.Init()
+	if torrent.Stats.Left != len(first)+len(second) {
+		t.Errorf("Pad files shouldn't count towards bytes left, got %d", torrent.Stats.Left)
+	}
+
+	firstFile, _ := os.Create(filepath.Join(dir, "a.bin"))
+	firstFile.Write(first)
+	secondFile, _ := os.Create(filepath.Join(dir, "b.bin"))
+	secondFile.Write(second)
+	defer firstFile.Close()
+	defer secondFile.Close()
+	files := []*os.File{firstFile, nil, secondFile}
+
+	// Verify both with SHA-1 over the v1 layout and with merkle hashes
+	for _, v2 := range []*V2Info{nil, torrent.v2} {
+		diskio := NewDiskIO(torrent.metaInfo, v2, ControllerDiskIOChans{})
+		diskio.files = files
+		finished := diskio.Verify()
+		if len(finished) != 3 || !finished[0] || !finished[1] || !finished[2] {
+			t.Errorf("Expected all 3 pieces to be finished, got %v (v2 %t)", finished, v2 != nil)
+		}
+	}
+}
+
+func TestParseHybridTorrentMismatch(t *testing.T) {
+	metaInfo := buildHybridTorrent(bytes.Repeat([]byte{'a'}, 20000), []byte("b"), 16384)
+	info := metaInfo["info"].(map[string]interface{})
+	info["files"].([]interface{})[2].(map[string]interface{})["path"] = []string{"c.bin"}
+	name := writeTestTorrent(t, metaInfo)
+	defer os.Remove(name)
+
+	if _, err := ParseTorrentFile(name); err == nil {
+		t.Errorf("Expected an error when the v1 and v2 files don't match")
+	}
+}
+
+func TestReceiveHandshakeAcceptsEitherInfoHash(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, 20)
+	v2 := bytes.Repeat([]byte{2}, 20)
+
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	handshake := append([]byte{byte(len(pstr))}, pstr...)
+	handshake = append(handshake, make([]byte, 8)...)
+	handshake = append(handshake, v2...)
+	handshake = append(handshake, PeerID...)
+	client.Write(handshake)
+
+	p := NewPeer([][]byte{v1, v2}, false, diskIOPeerChans{}, peerManagerChans{}, metadataPeerChans{})
+	p.conn = server
+	if err = p.receiveHandshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.infoHash, v2) {
+		t.Errorf("Expected to reply with the v2 info hash, got %x", p.infoHash)
+	}
+}
+
+// Metadata fetched for a magnet link has no piece layers, but the file tree
+// must still be known to lay out a v2 only torrent
+func TestSetInfoKeepsFileTree(t *testing.T) {
+	pieceLength := 16384
+	small := bytes.Repeat([]byte{'s'}, 1000)
+	other := bytes.Repeat([]byte{'o'}, 2000)
+	smallRoot, _ := testV2File(small, pieceLength)
+	otherRoot, _ := testV2File(other, pieceLength)
+	v2Info := map[string]interface{}{
+		"name":         "v2test",
+		"piece length": pieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"other.bin": map[string]interface{}{"": map[string]interface{}{"length": len(other), "pieces root": otherRoot}},
+			"small.bin": map[string]interface{}{"": map[string]interface{}{"length": len(small), "pieces root": smallRoot}},
+		},
+	}
+	hybridInfo := buildHybridTorrent(bytes.Repeat([]byte{'a'}, 20000), []byte("b"), pieceLength)["info"]
+
+	for _, test := range []struct {
+		info   interface{}
+		pieces int
+	}{{v2Info, 2}, {hybridInfo, 3}} {
+		m, _ := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+		torrent := m.Torrent()
+		if err := torrent.setInfo(bencodeTestTorrent(test.info)); err != nil {
+			t.Fatal(err)
+		}
+		if torrent.v2 == nil || len(torrent.v2.FileTree) != 2 {
+			t.Fatalf("Expected the v2 file tree to be kept, got %+v", torrent.v2)
+		}
+		if torrent.pieceCount() != test.pieces {
+			t.Errorf("Expected %d pieces but got %d", test.pieces, torrent.pieceCount())
+		}
+	}
+
+	// Pieces of a file larger than a piece can't be verified without its
+	// piece layer, so such a v2 only torrent is refused
+	v2 := &V2Info{FileTree: []FileTreeEntry{{Length: 3 * pieceLength, PiecesRoot: otherRoot}}}
+	if v2.checkMerkleHash(make([]byte, pieceLength), 0, 1, pieceLength) {
+		t.Errorf("Expected a piece without its piece layer not to verify")
+	}
+	v2Info["file tree"].(map[string]interface{})["large.bin"] = map[string]interface{}{"": map[string]interface{}{"length": 3 * pieceLength, "pieces root": otherRoot}}
+	m, _ := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	torrent := m.Torrent()
+	if err := torrent.setInfo(bencodeTestTorrent(v2Info)); err == nil {
+		t.Errorf("Expected an error for a v2 only torrent without its piece layers")
+	}
+}
+
+// A hybrid torrent fetched for a magnet link has no piece layers, so its
+// pieces are verified with their SHA-1 hashes instead
+func TestVerifyHybridWithoutPieceLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pieceLength := 16384
+	first := bytes.Repeat([]byte{'a'}, 40000)
+	second := bytes.Repeat([]byte{'b'}, 5000)
+	m, _ := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	torrent := m.Torrent()
+	if err = torrent.setInfo(bencodeTestTorrent(buildHybridTorrent(first, second, pieceLength)["info"])); err != nil {
+		t.Fatal(err)
+	}
+
+	firstFile, _ := os.Create(filepath.Join(dir, "a.bin"))
+	firstFile.Write(first)
+	secondFile, _ := os.Create(filepath.Join(dir, "b.bin"))
+	secondFile.Write(second)
+	defer firstFile.Close()
+	defer secondFile.Close()
+
+	diskio := NewDiskIO(torrent.metaInfo, torrent.v2, ControllerDiskIOChans{})
+	diskio.files = []*os.File{firstFile, nil, secondFile}
+	finished := diskio.Verify()
+	if len(finished) != 4 {
+		t.Fatalf("Expected 4 pieces but got %d", len(finished))
+	}
+	for i := range finished {
+		if !finished[i] {
+			t.Errorf("Expected piece %d to be finished", i)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2013 Jari Takkala. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/bencode-go"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/tomb"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Give up on a single HTTP request to a web seed after this long
+	webSeedTimeout = 60 * time.Second
+	// Wait this long before using a web seed again after an error
+	webSeedRetryInterval = 30 * time.Second
+	// Read and discard at most this much of a file from a web seed that
+	// doesn't support range requests
+	webSeedMaxDiscard = 4 * 1024 * 1024
+)
+
+// WebSeed downloads pieces over HTTP from a BEP 19 web seed. The Controller
+// treats it like any other peer, one that has every piece.
+type WebSeed struct {
+	url         string
+	peerName    string
+	metaInfo    MetaInfo
+	v2          *V2Info
+	client      *http.Client
+	noRanges    bool // the server sent a whole file instead of a range
+	diskIOChans diskIOPeerChans
+	chans       ControllerPeerChans // Requests from the Controller
+	rxChans     *ControllerRxChans  // Messages to the Controller
+	t           tomb.Tomb
+}
+
+// parseURLList returns the web seeds listed in the url-list key of a
+// metainfo file. The key may hold a single URL or a list of them.
+func parseURLList(buf []byte) (urls []string, err error) {
+	m, err := bencode.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	dict, _ := m.(map[string]interface{})
+	switch list := dict["url-list"].(type) {
+	case string:
+		if list != "" {
+			urls = append(urls, list)
+		}
+	case []interface{}:
+		for _, item := range list {
+			if s, ok := item.(string); ok && s != "" {
+				urls = append(urls, s)
+			}
+		}
+	}
+	return
+}
+
+func NewWebSeed(seedURL string, metaInfo MetaInfo, v2 *V2Info, diskIOChans diskIOPeerChans, rxChans *ControllerRxChans) *WebSeed {
+	ws := new(WebSeed)
+	ws.url = seedURL
+	ws.peerName = "webseed:" + seedURL
+	ws.metaInfo = metaInfo
+	ws.v2 = v2
+	ws.client = &http.Client{Timeout: webSeedTimeout}
+	ws.diskIOChans = diskIOChans
+	ws.chans = *NewControllerPeerChans()
+	ws.rxChans = rxChans
+	return ws
+}
+
+// fileURL returns the URL of a file in the torrent. In single file mode a
+// URL ending in a slash has the name appended. In multi file mode the name
+// of the torrent is the directory that holds the files.
+func (ws *WebSeed) fileURL(file int) string {
+	info := ws.metaInfo.Info
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(info.Name)
+		}
+		return ws.url
+	}
+	parts := []string{url.PathEscape(info.Name)}
+	for _, component := range info.Files[file].Path {
+		parts = append(parts, url.PathEscape(component))
+	}
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// fetchRange downloads length bytes starting at offset from a file. Once
+// the server has ignored a range, ranges far into a file aren't requested
+// again, since the whole file up to them would have to be read.
+func (ws *WebSeed) fetchRange(ctx context.Context, file int, offset int64, length int) ([]byte, error) {
+	if ws.noRanges && offset > webSeedMaxDiscard {
+		return nil, errors.New("web seed does not support range requests")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", ws.fileURL(file), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sent the whole file
+		ws.noRanges = true
+		if offset > webSeedMaxDiscard {
+			return nil, errors.New("web seed does not support range requests")
+		}
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(resp.Body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// fetchPiece downloads a piece with one range request for each file that
+// it spans. Pad files are all zeros and aren't requested. The requests are
+// abandoned when the WebSeed is stopped.
+func (ws *WebSeed) fetchPiece(index int) ([]byte, error) {
+	ranges := pieceRanges(&ws.metaInfo, ws.v2, index)
+	if ranges == nil {
+		return nil, fmt.Errorf("piece %d does not exist", index)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ws.t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var piece []byte
+	for _, r := range ranges {
+		if len(ws.metaInfo.Info.Files) > 0 && ws.metaInfo.Info.Files[r.file].isPad() {
+			piece = append(piece, make([]byte, r.length)...)
+			continue
+		}
+		buf, err := ws.fetchRange(ctx, r.file, r.offset, r.length)
+		if err != nil {
+			return nil, err
+		}
+		piece = append(piece, buf...)
+	}
+	return piece, nil
+}
+
+// sendChokeStatus tells the Controller whether to send requests to us
+func (ws *WebSeed) sendChokeStatus(isChoked bool) {
+	select {
+	case ws.rxChans.peer.chokeStatus <- PeerChokeStatus{peerName: ws.peerName, isChoked: isChoked}:
+	case <-ws.t.Dying():
+	}
+}
+
+// Stop stops this WebSeed
+func (ws *WebSeed) Stop() error {
+	log.Println("WebSeed : Stop : Stopping", ws.url)
+	ws.t.Kill(nil)
+	return ws.t.Wait()
+}
+
+// Run registers the web seed with the Controller and downloads the pieces
+// that it requests
+func (ws *WebSeed) Run() {
+	log.Println("WebSeed : Run : Started", ws.url)
+	defer ws.t.Done()
+	defer log.Println("WebSeed : Run : Completed", ws.url)
+
+	select {
+	case ws.rxChans.peerManager.newPeer <- *NewPeerComms(ws.peerName, ws.chans):
+	case <-ws.t.Dying():
+		return
+	}
+
+	// A web seed has every piece
+	count := len(ws.metaInfo.Info.Pieces) / 20
+	if ws.v2 != nil {
+		count = 0
+		for _, file := range ws.v2.FileTree {
+			count += numPieces(file.Length, ws.metaInfo.Info.PieceLength)
+		}
+	}
+	bitfield := make([]bool, count)
+	for i := range bitfield {
+		bitfield[i] = true
+	}
+	sendBitfieldOverChannel(ws.rxChans.peer.havePiece, ws.peerName, bitfield)
+	ws.sendChokeStatus(false)
+
+	// retry is only set while we're choked after an error
+	var retry <-chan time.Time
+	for {
+		select {
+		case request := <-ws.chans.requestPiece:
+			if retry != nil {
+				// The Controller forgot about this request when we choked
+				continue
+			}
+			buf, err := ws.fetchPiece(request.pieceNum)
+			if err != nil {
+				log.Printf("WebSeed : Run : Unable to fetch piece %d from %s: %s\n", request.pieceNum, ws.url, err)
+				ws.sendChokeStatus(true)
+				retry = time.After(webSeedRetryInterval)
+				continue
+			}
+			select {
+			case ws.diskIOChans.writePiece <- Piece{index: request.pieceNum, block: buf, peerName: ws.peerName}:
+			case <-ws.t.Dying():
+				return
+			}
+		case <-retry:
+			retry = nil
+			ws.sendChokeStatus(false)
+		case innerChan := <-ws.chans.havePiece:
+			// We don't care which pieces we have, the web seed has them all
+			for range innerChan {
+			}
+		case <-ws.chans.cancelPiece:
+			// Pieces are fetched in one go, so there's nothing to cancel
+		case <-ws.t.Dying():
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeWebSeedTorrent creates a multi file torrent named "seed" whose files
+// are served from dir, and returns the parsed torrent
+func writeWebSeedTorrent(t *testing.T, dir string, urlList interface{}) *Torrent {
+	first := bytes.Repeat([]byte{'a'}, 20000)
+	second := bytes.Repeat([]byte{'b'}, 15000)
+	os.MkdirAll(filepath.Join(dir, "seed", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "seed", "a.bin"), first, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "seed", "sub", "b c.bin"), second, 0644)
+
+	content := append(append([]byte(nil), first...), second...)
+	var pieces []byte
+	for i := 0; i < len(content); i += 16384 {
+		end := i + 16384
+		if end > len(content) {
+			end = len(content)
+		}
+		h := sha1.Sum(content[i:end])
+		pieces = append(pieces, h[:]...)
+	}
+	name := writeTestTorrent(t, map[string]interface{}{
+		"url-list": urlList,
+		"info": map[string]interface{}{
+			"name":         "seed",
+			"piece length": 16384,
+			"pieces":       string(pieces),
+			"files": []interface{}{
+				map[string]interface{}{"length": len(first), "path": []string{"a.bin"}},
+				map[string]interface{}{"length": len(second), "path": []string{"sub", "b c.bin"}},
+			},
+		},
+	})
+	defer os.Remove(name)
+	torrent, err := ParseTorrentFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &torrent
+}
+
+// createDiskFiles creates empty files in dir for each file in the torrent
+func createDiskFiles(t *testing.T, dir string, m MetaInfo) (files []*os.File) {
+	for i, file := range m.Info.Files {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Truncate(int64(file.Length))
+		files = append(files, f)
+	}
+	return
+}
+
+func TestPieceRanges(t *testing.T) {
+	var m MetaInfo
+	m.Info.PieceLength = 100
+	m.Info.Files = []FileDict{{Length: 150}, {Length: 0}, {Length: 30}, {Length: 70}}
+
+	expected := [][]fileRange{
+		{{0, 0, 100}},
+		{{0, 100, 50}, {2, 0, 30}, {3, 0, 20}},
+		{{3, 20, 50}},
+		nil,
+	}
+	for i, want := range expected {
+		got := pieceRanges(&m, nil, i)
+		if len(got) != len(want) {
+			t.Errorf("Piece %d: expected ranges %v but got %v", i, want, got)
+			continue
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("Piece %d: expected ranges %v but got %v", i, want, got)
+			}
+		}
+	}
+}
+
+func TestParseURLList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	torrent := writeWebSeedTorrent(t, dir, "http://example.com/files/")
+	if len(torrent.webSeeds) != 1 || torrent.webSeeds[0] != "http://example.com/files/" {
+		t.Errorf("Unexpected web seeds %v", torrent.webSeeds)
+	}
+	torrent = writeWebSeedTorrent(t, dir, []string{"http://a.example.com/", "http://b.example.com/"})
+	if len(torrent.webSeeds) != 2 {
+		t.Errorf("Unexpected web seeds %v", torrent.webSeeds)
+	}
+
+	ws := NewWebSeed("http://example.com/files", torrent.metaInfo, nil, diskIOPeerChans{}, nil)
+	if u := ws.fileURL(1); u != "http://example.com/files/seed/sub/b%20c.bin" {
+		t.Errorf("Unexpected file URL %s", u)
+	}
+}
+
+func TestWebSeedFetchAndWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer ts.Close()
+
+	torrent := writeWebSeedTorrent(t, dir, ts.URL+"/")
+	files := createDiskFiles(t, dir, torrent.metaInfo)
+	diskio := NewDiskIO(torrent.metaInfo, nil, ControllerDiskIOChans{})
+	diskio.files = files
+
+	ws := NewWebSeed(torrent.webSeeds[0], torrent.metaInfo, nil, diskio.peerChans, nil)
+	for i := 0; i < torrent.pieceCount(); i++ {
+		buf, err := ws.fetchPiece(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = diskio.writePiece(Piece{index: i, block: buf}); err != nil {
+			t.Errorf("Unable to write piece %d: %s", i, err)
+		}
+	}
+	for i, finished := range diskio.Verify() {
+		if !finished {
+			t.Errorf("Expected piece %d to be finished", i)
+		}
+	}
+
+	if err = diskio.writePiece(Piece{index: 0, block: make([]byte, 16384)}); err == nil {
+		t.Errorf("Expected a corrupt piece to be rejected")
+	}
+	if _, err = ws.fetchPiece(3); err == nil {
+		t.Errorf("Expected an error fetching a piece that doesn't exist")
+	}
+	ws.url = ts.URL + "/missing/"
+	if _, err = ws.fetchPiece(0); err == nil {
+		t.Errorf("Expected an error fetching from a missing URL")
+	}
+}
+
+// The Controller should hand out pieces to a web seed and DiskIO should
+// report them back to it
+func TestWebSeedDownloadsThroughController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer ts.Close()
+
+	torrent := writeWebSeedTorrent(t, dir, ts.URL)
+	diskIOChans := NewControllerDiskIOChans()
+	rxChans := NewControllerRxChans(diskIOChans, NewControllerPeerManagerChans(), NewPeerControllerChans())
+	diskio := NewDiskIO(torrent.metaInfo, nil, *diskIOChans)
+	diskio.files = createDiskFiles(t, dir, torrent.metaInfo)
+
+	controller := NewController(make([]bool, torrent.pieceCount()), torrent.pieceHashes(), rxChans)
+	go controller.Run()
+	defer controller.Stop()
+	ws := NewWebSeed(torrent.webSeeds[0], torrent.metaInfo, nil, diskio.peerChans, rxChans)
+	go ws.Run()
+	defer ws.Stop()
+
+	// Stand in for DiskIO.Run, which would change the working directory
+	received := make(map[int]bool)
+	timeout := time.After(5 * time.Second)
+	for len(received) < torrent.pieceCount() {
+		select {
+		case piece := <-diskio.peerChans.writePiece:
+			if err := diskio.writePiece(piece); err != nil {
+				t.Fatal(err)
+			}
+			received[piece.index] = true
+			diskIOChans.receivedPiece <- ReceivedPiece{pieceNum: piece.index, peerName: piece.peerName}
+		case <-timeout:
+			t.Fatalf("Only received pieces %v", received)
+		}
+	}
+	for i, finished := range diskio.Verify() {
+		if !finished {
+			t.Errorf("Expected piece %d to be finished", i)
+		}
+	}
+}
+
+// Stopping a web seed shouldn't wait for a request that the server never
+// answers
+func TestWebSeedStopCancelsFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	started := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	torrent := writeWebSeedTorrent(t, dir, ts.URL)
+	ws := NewWebSeed(torrent.webSeeds[0], torrent.metaInfo, nil, diskIOPeerChans{}, nil)
+	errCh := make(chan error)
+	go func() {
+		_, err := ws.fetchPiece(0)
+		errCh <- err
+	}()
+	<-started
+	ws.t.Kill(nil)
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Errorf("Expected an error from a cancelled fetch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the fetch to be cancelled when the web seed is stopped")
+	}
+}
+
+// A web seed that ignores range requests shouldn't be asked for ranges
+// that would mean reading a large part of a file
+func TestWebSeedIgnoresRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tulva")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(bytes.Repeat([]byte{'a'}, 20000))
+	}))
+	defer ts.Close()
+
+	torrent := writeWebSeedTorrent(t, dir, ts.URL+"/")
+	ws := NewWebSeed(torrent.webSeeds[0], torrent.metaInfo, nil, diskIOPeerChans{}, nil)
+	buf, err := ws.fetchRange(context.Background(), 0, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, bytes.Repeat([]byte{'a'}, 10)) {
+		t.Errorf("Expected the range to be read from the whole file, got %q", buf)
+	}
+	if !ws.noRanges {
+		t.Errorf("Expected the web seed to be marked as not supporting ranges")
+	}
+	if _, err = ws.fetchRange(context.Background(), 0, webSeedMaxDiscard+1, 10); err == nil {
+		t.Errorf("Expected an error fetching far into a file without ranges")
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+}